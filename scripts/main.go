@@ -1,13 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/joho/godotenv"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -106,13 +115,50 @@ func seedStories(pool *pgxpool.Pool) error {
 		message TEXT NOT NULL,
 		sender TEXT NOT NULL,
 		timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
-);`
+);
+CREATE INDEX IF NOT EXISTS chat_sessions_user_session_idx ON chat_sessions(user_id, session_id, timestamp);`
 
 	_, err = pool.Exec(ctx, sqlStmt)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Regenerated replies and edited prompts keep the messages they replace
+	_, err = pool.Exec(ctx, `ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+	ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS version_of INTEGER;
+	CREATE INDEX IF NOT EXISTS chat_sessions_version_of_idx ON chat_sessions(version_of);`)
+	if err != nil {
+		return fmt.Errorf("error migrating chat_sessions: %w", err)
+	}
+
+	// Messages form a tree, active ones are the branch the chat goes on from.
+	// Existing messages get the parent they had in the single line of
+	// conversation, version_of only serves this backfill.
+	hasParents := false
+	err = pool.QueryRow(ctx, `SELECT EXISTS (
+		SELECT 1 FROM information_schema.columns WHERE table_name = 'chat_sessions' AND column_name = 'parent_id'
+	)`).Scan(&hasParents)
+	if err != nil {
+		return fmt.Errorf("error migrating chat_sessions: %w", err)
+	}
+	if !hasParents {
+		_, err = pool.Exec(ctx, `ALTER TABLE chat_sessions ADD COLUMN parent_id INTEGER;
+		CREATE INDEX IF NOT EXISTS chat_sessions_parent_id_idx ON chat_sessions(parent_id);
+		UPDATE chat_sessions c SET parent_id = (
+			SELECT MAX(p.id) FROM chat_sessions p
+			WHERE p.user_id = c.user_id AND p.session_id = c.session_id AND p.id < c.id
+		) WHERE c.version_of IS NULL;
+		UPDATE chat_sessions c SET parent_id = r.parent_id
+		FROM chat_sessions r WHERE c.version_of = r.id AND c.sender = 'user';
+		UPDATE chat_sessions c SET parent_id = (
+			SELECT MAX(p.id) FROM chat_sessions p
+			WHERE p.user_id = c.user_id AND p.session_id = c.session_id AND p.id < c.id AND p.sender = 'user'
+		) WHERE c.version_of IS NOT NULL AND c.sender = 'model';`)
+		if err != nil {
+			return fmt.Errorf("error migrating chat_sessions: %w", err)
+		}
+	}
+
 	fmt.Println("Seeded stories data.")
 	return nil
 }
@@ -137,6 +183,25 @@ func SeedStoryService() {
 		log.Fatalf("Error seeding users: %v", err)
 	}
 
+	if err := migrateFileData(pool); err != nil {
+		log.Fatalf("Error moving files to the blob store: %v", err)
+	}
+	if err := seedSessions(pool); err != nil {
+		log.Fatalf("Error seeding sessions: %v", err)
+	}
+
+	if err := seedUsage(pool); err != nil {
+		log.Fatalf("Error seeding usage: %v", err)
+	}
+
+	if err := seedJobs(pool); err != nil {
+		log.Fatalf("Error seeding jobs: %v", err)
+	}
+
+	if err := seedPreferences(pool); err != nil {
+		log.Fatalf("Error seeding preferences: %v", err)
+	}
+
 	log.Println("Database seeding completed successfully!")
 }
 
@@ -153,7 +218,7 @@ func seedUploads(pool *pgxpool.Pool) error {
 		session_id TEXT NOT NULL,
 		filename VARCHAR(255) NOT NULL,
 		content_type TEXT NOT NULL,
-		file_data BYTEA NOT NULL,
+		file_data BYTEA,
 		upload_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);`
 
@@ -162,10 +227,358 @@ func seedUploads(pool *pgxpool.Pool) error {
 		log.Fatal(err)
 	}
 
+	// File content moved to the blob store, rows only keep where it is
+	_, err = pool.Exec(ctx, `
+	ALTER TABLE session_files ALTER COLUMN file_data DROP NOT NULL;
+	ALTER TABLE session_files ADD COLUMN IF NOT EXISTS storage_key TEXT;
+	ALTER TABLE session_files ADD COLUMN IF NOT EXISTS size BIGINT;
+	ALTER TABLE session_files ADD COLUMN IF NOT EXISTS checksum TEXT;
+	ALTER TABLE session_files ADD COLUMN IF NOT EXISTS after_message_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE session_files ADD COLUMN IF NOT EXISTS metadata JSONB;
+	ALTER TABLE session_files ADD COLUMN IF NOT EXISTS page_notes TEXT;
+	ALTER TABLE session_files ADD COLUMN IF NOT EXISTS text_content TEXT;`)
+	if err != nil {
+		return fmt.Errorf("error migrating session_files: %w", err)
+	}
+
 	fmt.Println("Seeded stories data.")
 	return nil
 }
 
+// fileDataBatch is the number of legacy files read from the database at once
+const fileDataBatch = 20
+
+// putBlob stores data under key in the blob store of the story service
+type putBlob func(ctx context.Context, key string, data []byte, contentType string) error
+
+// newPutBlob opens the blob store selected by BLOB_STORE like the story
+// service does. BLOB_STORE_DIR defaults to the story service's directory.
+func newPutBlob(ctx context.Context) (putBlob, error) {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "", "local":
+		root := os.Getenv("BLOB_STORE_DIR")
+		if root == "" {
+			root = "../story-service/data/blobs"
+		}
+		return func(ctx context.Context, key string, data []byte, contentType string) error {
+			p := filepath.Join(root, filepath.FromSlash(key))
+			if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+				return err
+			}
+			return os.WriteFile(p, data, 0o640)
+		}, nil
+	case "s3":
+		bucket := os.Getenv("S3_BUCKET")
+		client, err := minio.New(os.Getenv("S3_ENDPOINT"), &minio.Options{
+			Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+			Secure: os.Getenv("S3_USE_SSL") != "false",
+			Region: os.Getenv("S3_REGION"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, key string, data []byte, contentType string) error {
+			_, err := client.PutObject(ctx, bucket, key, bytes.NewReader(data), int64(len(data)),
+				minio.PutObjectOptions{ContentType: contentType})
+			return err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", kind)
+	}
+}
+
+// blobKey returns a storage key in the story service's scheme, the escaped
+// user ID and a random name
+func blobKey(userID, filename string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	return fmt.Sprintf("users/%s/%s%s", url.PathEscape(userID), hex.EncodeToString(b), url.PathEscape(ext)), nil
+}
+
+// legacyFile is a session_files row whose content is still in file_data
+type legacyFile struct {
+	id          int64
+	userID      string
+	filename    string
+	contentType string
+	data        []byte
+}
+
+// migrateFileData moves the content of files uploaded before the blob store
+// out of session_files.file_data
+func migrateFileData(pool *pgxpool.Pool) error {
+	ctx := context.Background()
+	// Rows already in the blob store only keep a stale copy
+	_, err := pool.Exec(ctx, "UPDATE session_files SET file_data = NULL WHERE storage_key IS NOT NULL AND file_data IS NOT NULL")
+	if err != nil {
+		return err
+	}
+
+	var pending int
+	err = pool.QueryRow(ctx, "SELECT COUNT(*) FROM session_files WHERE storage_key IS NULL AND file_data IS NOT NULL").Scan(&pending)
+	if err != nil {
+		return err
+	}
+	if pending == 0 {
+		return nil
+	}
+	put, err := newPutBlob(ctx)
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	lastID := int64(0)
+	for {
+		rows, err := pool.Query(ctx, `SELECT id, user_id, filename, content_type, file_data FROM session_files
+		WHERE storage_key IS NULL AND file_data IS NOT NULL AND id > $1 ORDER BY id LIMIT $2`, lastID, fileDataBatch)
+		if err != nil {
+			return err
+		}
+		files := []legacyFile{}
+		for rows.Next() {
+			f := legacyFile{}
+			if err := rows.Scan(&f.id, &f.userID, &f.filename, &f.contentType, &f.data); err != nil {
+				rows.Close()
+				return err
+			}
+			files = append(files, f)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			break
+		}
+
+		for _, f := range files {
+			key, err := blobKey(f.userID, f.filename)
+			if err != nil {
+				return err
+			}
+			if err := put(ctx, key, f.data, f.contentType); err != nil {
+				return fmt.Errorf("storing file %d: %w", f.id, err)
+			}
+			checksum := sha256.Sum256(f.data)
+			_, err = pool.Exec(ctx, `UPDATE session_files SET storage_key = $1, size = $2, checksum = $3, file_data = NULL
+			WHERE id = $4 AND storage_key IS NULL`, key, len(f.data), hex.EncodeToString(checksum[:]), f.id)
+			if err != nil {
+				return fmt.Errorf("updating file %d: %w", f.id, err)
+			}
+			moved++
+			lastID = f.id
+		}
+	}
+
+	fmt.Printf("Moved %d files to the blob store.\n", moved)
+	return nil
+}
+
+func seedSessions(pool *pgxpool.Pool) error {
+	ctx := context.Background()
+	_, err := pool.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`)
+	if err != nil {
+		return fmt.Errorf("error creating extension: %w", err)
+	}
+
+	sqlStmt := `CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY DEFAULT uuid_generate_v4()::text,
+		user_id TEXT NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		file_id INTEGER REFERENCES session_files(id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions(user_id);`
+
+	_, err = pool.Exec(ctx, sqlStmt)
+	if err != nil {
+		return fmt.Errorf("error creating sessions table: %w", err)
+	}
+
+	if err := backfillSessions(ctx, pool); err != nil {
+		return fmt.Errorf("error backfilling sessions: %w", err)
+	}
+
+	_, err = pool.Exec(ctx, `
+	UPDATE sessions SET file_id = f.id
+	FROM (SELECT session_id, MIN(id) AS id FROM session_files GROUP BY session_id) f
+	WHERE sessions.id = f.session_id AND sessions.file_id IS NULL`)
+	if err != nil {
+		return fmt.Errorf("error linking session files: %w", err)
+	}
+
+	_, err = pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS session_summaries (
+		session_id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		summary TEXT NOT NULL,
+		covered_message_id INTEGER NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		return fmt.Errorf("error creating session_summaries table: %w", err)
+	}
+
+	fmt.Println("Seeded sessions data.")
+	return nil
+}
+
+// sessionTables hold the session_id and user_id of the rows of a session
+var sessionTables = []string{"chat_sessions", "session_files", "session_summaries", "model_usage", "upload_jobs"}
+
+// backfillSessions creates the sessions that used to exist only as
+// session_id values chosen by clients. Each user of a session_id gets a
+// session of their own: the first user keeps the ID, the others get a new
+// one and their rows are moved to it.
+func backfillSessions(ctx context.Context, pool *pgxpool.Pool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+	CREATE TEMP TABLE session_backfill ON COMMIT DROP AS
+	SELECT session_id, user_id, created_at, updated_at,
+		CASE WHEN taken OR ROW_NUMBER() OVER (PARTITION BY session_id ORDER BY created_at, user_id) > 1
+			THEN uuid_generate_v4()::text ELSE session_id END AS new_id
+	FROM (
+		SELECT c.session_id, c.user_id, MIN(c.timestamp) AS created_at, MAX(c.timestamp) AS updated_at,
+			EXISTS (SELECT 1 FROM sessions s WHERE s.id = c.session_id) AS taken
+		FROM chat_sessions c
+		WHERE NOT EXISTS (SELECT 1 FROM sessions s WHERE s.id = c.session_id AND s.user_id = c.user_id)
+		GROUP BY c.session_id, c.user_id
+	) groups`)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range sessionTables {
+		var exists bool
+		if err := tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		_, err = tx.Exec(ctx, fmt.Sprintf(`
+		UPDATE %s t SET session_id = b.new_id
+		FROM session_backfill b
+		WHERE t.session_id = b.session_id AND t.user_id = b.user_id AND b.new_id <> b.session_id`, table))
+		if err != nil {
+			return fmt.Errorf("moving %s: %w", table, err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+	INSERT INTO sessions (id, user_id, created_at, updated_at)
+	SELECT new_id, user_id, created_at, updated_at FROM session_backfill`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func seedUsage(pool *pgxpool.Pool) error {
+	ctx := context.Background()
+	sqlStmt := `CREATE TABLE IF NOT EXISTS model_usage (
+		id SERIAL PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		model TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		prompt_tokens INTEGER NOT NULL,
+		candidate_tokens INTEGER NOT NULL,
+		total_tokens INTEGER NOT NULL,
+		cost NUMERIC(14, 8) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS model_usage_user_created_idx ON model_usage(user_id, created_at);
+	CREATE TABLE IF NOT EXISTS quota_counters (
+		key TEXT PRIMARY KEY,
+		window_start TIMESTAMPTZ NOT NULL,
+		count BIGINT NOT NULL
+	);`
+
+	_, err := pool.Exec(ctx, sqlStmt)
+	if err != nil {
+		return fmt.Errorf("error creating usage tables: %w", err)
+	}
+
+	fmt.Println("Seeded usage data.")
+	return nil
+}
+
+func seedJobs(pool *pgxpool.Pool) error {
+	ctx := context.Background()
+	sqlStmt := `CREATE TABLE IF NOT EXISTS upload_jobs (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		session_id TEXT NOT NULL,
+		file_id INTEGER NOT NULL,
+		file_ids BIGINT[],
+		mime_type TEXT NOT NULL,
+		options JSONB NOT NULL,
+		status TEXT NOT NULL,
+		result TEXT,
+		error TEXT NOT NULL DEFAULT '',
+		error_code TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		started_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	ALTER TABLE upload_jobs ADD COLUMN IF NOT EXISTS file_ids BIGINT[];
+	UPDATE upload_jobs SET file_ids = ARRAY[file_id] WHERE file_ids IS NULL;
+	ALTER TABLE upload_jobs ALTER COLUMN file_ids SET NOT NULL;
+	ALTER TABLE upload_jobs ADD COLUMN IF NOT EXISTS progress_done INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE upload_jobs ADD COLUMN IF NOT EXISTS progress_total INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE upload_jobs ADD COLUMN IF NOT EXISTS new_session BOOLEAN NOT NULL DEFAULT FALSE;
+	ALTER TABLE upload_jobs ADD COLUMN IF NOT EXISTS run_after TIMESTAMPTZ;
+	ALTER TABLE upload_jobs ADD COLUMN IF NOT EXISTS message_id INTEGER;
+	CREATE INDEX IF NOT EXISTS upload_jobs_status_created_idx ON upload_jobs(status, created_at);
+	CREATE INDEX IF NOT EXISTS upload_jobs_session_idx ON upload_jobs(user_id, session_id);
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		body BYTEA NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, key)
+	);
+	ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS request_hash TEXT NOT NULL DEFAULT '';`
+
+	_, err := pool.Exec(ctx, sqlStmt)
+	if err != nil {
+		return fmt.Errorf("error creating job tables: %w", err)
+	}
+
+	fmt.Println("Seeded jobs data.")
+	return nil
+}
+
+func seedPreferences(pool *pgxpool.Pool) error {
+	ctx := context.Background()
+	sqlStmt := `CREATE TABLE IF NOT EXISTS user_preferences (
+		user_id TEXT PRIMARY KEY,
+		metadata_opt_out TEXT[] NOT NULL DEFAULT '{}',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := pool.Exec(ctx, sqlStmt)
+	if err != nil {
+		return fmt.Errorf("error creating user_preferences table: %w", err)
+	}
+
+	fmt.Println("Seeded preferences data.")
+	return nil
+}
+
 func main() {
 	err := godotenv.Load(".env")
 	if err != nil {
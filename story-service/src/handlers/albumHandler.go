@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// UploadAlbum takes many photos, or zip archives of photos, in the "files"
+// field and queues one narrative about all of them, in capture order.
+// Without a session_id the album starts a new session.
+func UploadAlbum(c *gin.Context) {
+	userID := middlewares.UserID(c)
+	sessionID := c.Query("session_id")
+
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["files"]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing values"})
+		return
+	}
+
+	options := services.StoryOptions{
+		Style:    c.PostForm("style"),
+		Length:   c.PostForm("length"),
+		Language: c.PostForm("language"),
+		Audience: c.PostForm("audience"),
+		Album:    true,
+	}
+
+	images, err := services.ReadAlbumImages(form.File["files"])
+	if err != nil {
+		if errors.Is(err, services.ErrUnsupportedMediaType) || errors.Is(err, services.ErrMediaTypeMismatch) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	services.OrderAlbumImages(images)
+
+	// Check the options for the photos the job builds the prompt for
+	if _, err := services.BuildStoryPrompt(options, images[0].MIMEType); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	title := fmt.Sprintf("Album of %d photos", len(images))
+	session, err := services.EnsureSession(userID, sessionID, title)
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	sessionID, newSession := session.ID, sessionID == ""
+
+	fileIDs, err := services.SaveAlbumImages(c, userID, sessionID, images)
+	if err != nil {
+		discardUpload(c, userID, sessionID, nil, newSession)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	job, ok := queueUploadJob(c, uploadJobInput{
+		userID:     userID,
+		sessionID:  sessionID,
+		fileIDs:    fileIDs,
+		mimeType:   images[0].MIMEType,
+		options:    options,
+		newSession: newSession,
+	})
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job": job, "photos": len(images)})
+}
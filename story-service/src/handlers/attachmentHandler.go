@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// ListSessionFiles lists the files of a session in upload order
+func ListSessionFiles(c *gin.Context) {
+	userID := middlewares.UserID(c)
+	sessionID := c.Param("id")
+
+	if _, err := services.GetSession(userID, sessionID); err != nil {
+		sessionError(c, err)
+		return
+	}
+	attachments, err := services.ListAttachments(userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"files": attachments})
+}
+
+// AddSessionFile attaches a file to a session without generating a story.
+// The model sees it with the next chat message. PDFs long enough to be read
+// in parts go through UploadData instead.
+func AddSessionFile(c *gin.Context) {
+	userID := middlewares.UserID(c)
+	sessionID := c.Param("id")
+
+	file, _ := c.FormFile("file")
+	if file == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file"})
+		return
+	}
+	if _, err := services.GetSession(userID, sessionID); err != nil {
+		sessionError(c, err)
+		return
+	}
+
+	mimeType, err := services.DetectFileType(file)
+	if err != nil {
+		if errors.Is(err, services.ErrUnsupportedMediaType) || errors.Is(err, services.ErrMediaTypeMismatch) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := services.CheckAttachablePDF(file, mimeType); err != nil {
+		if errors.Is(err, services.ErrPDFTooLong) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	fileID, err := services.SaveFileData(c, userID, sessionID, file, mimeType)
+	if err != nil {
+		saveFileError(c, err)
+		return
+	}
+	if err := services.SetSessionFile(userID, sessionID, fileID); err != nil {
+		if discardErr := services.DiscardUpload(c, userID, sessionID, []int64{fileID}, false); discardErr != nil {
+			log.Printf("error discarding file %d: %v", fileID, discardErr)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	attachment, err := services.GetAttachment(userID, sessionID, fileID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"file": attachment})
+}
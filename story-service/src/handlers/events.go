@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/gorilla/websocket"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// eventConn serializes writes to a WebSocket, which job updates share with
+// the read loop
+type eventConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func (c *eventConn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+// newEventID returns a random identifier for a server event.
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeEvent wraps data in an event envelope and writes it to the WebSocket.
+// replyTo is the ID of the client event this one answers, if any.
+func writeEvent(conn *eventConn, eventType models.EventType, replyTo string, data interface{}) error {
+	event := models.Event{
+		Version:   models.EventProtocolVersion,
+		Type:      eventType,
+		ID:        newEventID(),
+		Timestamp: time.Now().UTC(),
+		ReplyTo:   replyTo,
+	}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		event.Data = raw
+	}
+	return conn.WriteJSON(event)
+}
+
+func writeErrorEvent(conn *eventConn, replyTo string, code models.ErrorCode, message string) error {
+	return writeEvent(conn, models.EventError, replyTo, models.ErrorEvent{Code: code, Message: message})
+}
+
+// writeQuotaErrorEvent reports a rejected chat turn. Quota errors carry the
+// limit and when to retry.
+func writeQuotaErrorEvent(conn *eventConn, replyTo string, err error) error {
+	var quotaErr *services.QuotaError
+	if !errors.As(err, &quotaErr) {
+		return writeErrorEvent(conn, replyTo, models.ErrorCodeInternal, err.Error())
+	}
+	return writeEvent(conn, models.EventError, replyTo, models.ErrorEvent{
+		Code:       models.ErrorCodeQuotaExceeded,
+		Message:    quotaErr.Error(),
+		Limit:      quotaErr.Limit,
+		RetryAfter: middlewares.RetryAfterSeconds(quotaErr),
+	})
+}
+
+// historyMessages converts the model history into the history event payload.
+func historyMessages(history []*genai.Content) []models.HistoryMessage {
+	messages := []models.HistoryMessage{}
+	for _, content := range history {
+		for _, part := range content.Parts {
+			switch p := part.(type) {
+			case genai.Text:
+				messages = append(messages, models.HistoryMessage{Role: content.Role, Text: string(p)})
+			case genai.Blob:
+				messages = append(messages, models.HistoryMessage{
+					Role:  content.Role,
+					Media: &models.MediaEvent{MIMEType: p.MIMEType, Data: p.Data},
+				})
+			}
+		}
+	}
+	return messages
+}
+
+// generationStatus maps a generation failure to an HTTP status. Refusals are
+// about the content, other failures are on the model's side.
+func generationStatus(err error) int {
+	switch services.GenerationErrorCode(err) {
+	case models.ErrorCodeBlocked, models.ErrorCodeRecitation:
+		return http.StatusUnprocessableEntity
+	case models.ErrorCodeMaxTokens, models.ErrorCodeEmptyResponse:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// ExportSession downloads the active branch of a session as Markdown, HTML,
+// PDF or EPUB. turns=model leaves out the user's turns.
+func ExportSession(c *gin.Context) {
+	turns := c.DefaultQuery("turns", "all")
+	if turns != "all" && turns != "model" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid turns, expected all or model"})
+		return
+	}
+
+	export, err := services.ExportSession(c, middlewares.UserID(c), c.Param("id"), services.ExportOptions{
+		Format:    c.DefaultQuery("format", services.ExportMarkdown),
+		ModelOnly: turns == "model",
+	})
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidExportFormat) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrPDFUnsupportedText) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		sessionError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": export.Filename}))
+	c.Data(http.StatusOK, export.ContentType, export.Data)
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// GetJob returns the status of an upload job, and its story once it succeeded
+func GetJob(c *gin.Context) {
+	job, err := services.GetJob(middlewares.UserID(c), c.Param("id"))
+	if err != nil {
+		if err == services.ErrJobNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// ListSessionMessages lists the messages of the active branch of a session,
+// whose IDs the edit_message event refers to
+func ListSessionMessages(c *gin.Context) {
+	userID := middlewares.UserID(c)
+	sessionID := c.Param("id")
+
+	if _, err := services.GetSession(userID, sessionID); err != nil {
+		sessionError(c, err)
+		return
+	}
+	messages, err := services.LoadMessages(userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
+}
+
+// GetMessageTree lists every message of a session with its parent, for
+// clients to show the branches of the story
+func GetMessageTree(c *gin.Context) {
+	userID := middlewares.UserID(c)
+	sessionID := c.Param("id")
+
+	if _, err := services.GetSession(userID, sessionID); err != nil {
+		sessionError(c, err)
+		return
+	}
+	messages, err := services.ListMessageTree(userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
+}
+
+// ListMessageVersions lists the versions of a message kept by regenerating
+// or editing it
+func ListMessageVersions(c *gin.Context) {
+	userID := middlewares.UserID(c)
+	sessionID := c.Param("id")
+
+	if _, err := services.GetSession(userID, sessionID); err != nil {
+		sessionError(c, err)
+		return
+	}
+	versions, err := services.ListMessageVersions(userID, sessionID, c.Param("messageId"))
+	if err != nil {
+		if err == services.ErrMessageNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"versions": versions})
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+type metadataPreferences struct {
+	OptOut []string `json:"opt_out"`
+}
+
+// GetMetadataPreferences returns the metadata fields kept out of prompts and
+// the fields that can be kept out
+func GetMetadataPreferences(c *gin.Context) {
+	optOut, err := services.GetMetadataOptOut(middlewares.UserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"opt_out": optOut, "fields": services.MetadataFields})
+}
+
+// UpdateMetadataPreferences sets the metadata fields kept out of prompts
+func UpdateMetadataPreferences(c *gin.Context) {
+	req := metadataPreferences{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.OptOut == nil {
+		req.OptOut = []string{}
+	}
+
+	if err := services.SetMetadataOptOut(middlewares.UserID(c), req.OptOut); err != nil {
+		if errors.Is(err, services.ErrInvalidMetadataField) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"opt_out": req.OptOut, "fields": services.MetadataFields})
+}
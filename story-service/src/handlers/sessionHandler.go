@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+type sessionRequest struct {
+	Title string `json:"title"`
+}
+
+func sessionError(c *gin.Context, err error) {
+	if err == services.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+func CreateSession(c *gin.Context) {
+	userID := middlewares.UserID(c)
+
+	req := sessionRequest{}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	session, err := services.CreateSession(userID, req.Title)
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"session": session})
+}
+
+func ListSessions(c *gin.Context) {
+	userID := middlewares.UserID(c)
+
+	sessions, err := services.ListSessions(userID)
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+func GetSession(c *gin.Context) {
+	session, err := services.GetSession(middlewares.UserID(c), c.Param("id"))
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session": session})
+}
+
+func UpdateSession(c *gin.Context) {
+	req := sessionRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	session, err := services.UpdateSessionTitle(middlewares.UserID(c), c.Param("id"), req.Title)
+	if err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session": session})
+}
+
+func DeleteSession(c *gin.Context) {
+	if err := services.DeleteSession(c, middlewares.UserID(c), c.Param("id")); err != nil {
+		sessionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
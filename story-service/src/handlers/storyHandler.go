@@ -3,54 +3,147 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"reflect"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"cloud.google.com/go/vertexai/genai"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
 	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
 	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+	"google.golang.org/api/iterator"
 )
 
+// UploadData saves the uploaded file and queues the generation of its story.
+// The story is delivered through the returned job. Without a session_id the
+// file starts a new session, whose ID is the job's session_id.
 func UploadData(c *gin.Context) {
 	file, _ := c.FormFile("file")
 
-	user_id := c.Query("user_id")
+	user_id := middlewares.UserID(c)
 	session_id := c.Query("session_id")
 
-	if file == nil || user_id == "" || session_id == "" {
+	if file == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing values"})
 		return
 	}
 
-	if err := services.SaveFileData(user_id, session_id, file); err != nil {
+	mimeType, err := services.DetectFileType(file)
+	if err != nil {
+		if errors.Is(err, services.ErrUnsupportedMediaType) || errors.Is(err, services.ErrMediaTypeMismatch) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	resp, err := services.GenerateContentFromFile(c, file)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Check the options now, the prompt is built again by the job
+	options := services.StoryOptions{
+		Style:    c.PostForm("style"),
+		Length:   c.PostForm("length"),
+		Language: c.PostForm("language"),
+		Audience: c.PostForm("audience"),
+	}
+	if _, err := services.BuildStoryPrompt(options, mimeType); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	content, err := parseContentResponse(resp)
+	session, err := services.EnsureSession(user_id, session_id, filepath.Base(file.Filename))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		sessionError(c, err)
 		return
 	}
+	session_id, newSession := session.ID, session_id == ""
 
-	story := models.Message{Content: content, Sender: "model"}
-	err = services.SaveMessage(user_id, session_id, story)
+	// From here on a failure removes the file and a session created for it
+	// again, the job does the same when generation fails
+	fileID, err := services.SaveFileData(c, user_id, session_id, file, mimeType)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		discardUpload(c, user_id, session_id, nil, newSession)
+		saveFileError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"story": story})
+	job, ok := queueUploadJob(c, uploadJobInput{
+		userID:     user_id,
+		sessionID:  session_id,
+		fileIDs:    []int64{fileID},
+		mimeType:   mimeType,
+		options:    options,
+		newSession: newSession,
+	})
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job": job})
+}
+
+// uploadJobInput is what an upload job is created from, the saved files
+// of the upload and the options of their story
+type uploadJobInput struct {
+	userID     string
+	sessionID  string
+	fileIDs    []int64
+	mimeType   string
+	options    services.StoryOptions
+	newSession bool
+}
+
+// queueUploadJob makes the first file the session's source and queues the
+// story of the files. When that fails it discards the upload, answers 500
+// and returns false.
+func queueUploadJob(c *gin.Context, in uploadJobInput) (*models.Job, bool) {
+	fail := func(err error) (*models.Job, bool) {
+		discardUpload(c, in.userID, in.sessionID, in.fileIDs, in.newSession)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err := services.SetSessionFile(in.userID, in.sessionID, in.fileIDs[0]); err != nil {
+		return fail(err)
+	}
+	job, err := services.CreateUploadJob(in.userID, in.sessionID, in.fileIDs, in.mimeType, in.options, in.newSession)
+	if err != nil {
+		return fail(err)
+	}
+	return job, true
+}
+
+// saveFileError answers a file that could not be saved, documents that are
+// too large or unreadable are the client's fault
+func saveFileError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrDocumentTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrUnreadableDocument):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// discardUpload undoes an upload that failed before its job was queued
+func discardUpload(c *gin.Context, userID, sessionID string, fileIDs []int64, newSession bool) {
+	if err := services.DiscardUpload(c, userID, sessionID, fileIDs, newSession); err != nil {
+		log.Printf("error discarding upload to session %s: %v", sessionID, err)
+	}
+}
+
+// GetStoryStyles lists the styles accepted by UploadData
+func GetStoryStyles(c *gin.Context) {
+	styles := []gin.H{}
+	for _, style := range services.ListStoryStyles() {
+		styles = append(styles, gin.H{"name": style.Name, "description": style.Description})
+	}
+	c.JSON(http.StatusOK, gin.H{"styles": styles, "lengths": services.StoryLengths()})
 }
 
 // WebSocket Upgrader
@@ -60,99 +153,403 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// WsHandler is WebSocket handler function
+// WsHandler is WebSocket handler function. Every frame in both directions is
+// a models.Event.
 func WsHandler(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Print("upgrade: ", err)
 		return
 	}
-	defer conn.Close()
+	defer ws.Close()
+	conn := &eventConn{Conn: ws}
 
-	userID := c.Query("user_id")
+	userID := middlewares.UserID(c)
 	sessionID := c.Query("session_id")
 
-	gemini := services.GenaiClient.GenerativeModel(services.ModelName)
-	chat := gemini.StartChat()
-
-	chat.History, err = services.LoadChatHistory(userID, sessionID)
-	if err != nil {
-		conn.WriteJSON(gin.H{"error": err.Error()})
+	if _, err := services.GetSession(userID, sessionID); err != nil {
+		code := models.ErrorCodeInternal
+		if err == services.ErrSessionNotFound {
+			code = models.ErrorCodeNotFound
+		}
+		writeErrorEvent(conn, "", code, err.Error())
 		return
 	}
 
-	historyData, err := json.Marshal(chat.History)
+	history, lastAttachment, err := services.LoadChatHistory(c, userID, sessionID)
 	if err != nil {
-		conn.WriteJSON(gin.H{"error": err.Error()})
+		writeErrorEvent(conn, "", models.ErrorCodeInternal, err.Error())
 		return
 	}
+	state := &chatState{chat: services.Generator.StartChat(history), lastAttachment: lastAttachment}
 
-	// Send the response back to the WebSocket client
-	if err := conn.WriteMessage(websocket.TextMessage, historyData); err != nil {
+	// Send the history to the WebSocket client
+	historyEvent := models.HistoryEvent{Messages: historyMessages(state.chat.History())}
+	if err := writeEvent(conn, models.EventHistory, "", historyEvent); err != nil {
 		log.Println("write:", err)
 		return
 	}
 
+	// Push the progress of the session's upload jobs
+	jobs, unsubscribe := services.SubscribeJobs(userID, sessionID)
+	defer unsubscribe()
+	go forwardJobs(conn, jobs)
+	if active, err := services.ListActiveJobs(userID, sessionID); err != nil {
+		log.Printf("error listing jobs: %v", err)
+	} else {
+		for _, job := range active {
+			if err := writeEvent(conn, models.EventJob, "", job); err != nil {
+				log.Println("write:", err)
+				return
+			}
+		}
+	}
+
 	for {
-		// Read message from WebSocket
-		_, message, err := conn.ReadMessage()
+		// Read event from WebSocket
+		_, frame, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("read:", err)
 			break
 		}
-		log.Printf("recv: %s", message)
+		log.Printf("recv: %s", frame)
 
-		// Make chat request with received message
-		response, err := makeChatRequests(c, chat, string(message))
+		event := models.Event{}
+		if err := json.Unmarshal(frame, &event); err != nil {
+			err = writeErrorEvent(conn, "", models.ErrorCodeBadRequest, "invalid event: "+err.Error())
+		} else if event.Version != models.EventProtocolVersion {
+			err = writeErrorEvent(conn, event.ID, models.ErrorCodeUnsupportedVersion,
+				fmt.Sprintf("unsupported protocol version %d, expected %d", event.Version, models.EventProtocolVersion))
+		} else {
+			switch event.Type {
+			case models.EventPing:
+				err = writeEvent(conn, models.EventPing, event.ID, nil)
+			case models.EventUserMessage:
+				if quotaErr := services.TakeChatQuota(c, userID); quotaErr != nil {
+					err = writeQuotaErrorEvent(conn, event.ID, quotaErr)
+				} else {
+					err = handleUserMessage(c, conn, state, userID, sessionID, event)
+				}
+			case models.EventSwitchBranch:
+				err = handleSwitchBranch(c, conn, state, userID, sessionID, event)
+			case models.EventRegenerate, models.EventEditMessage:
+				if quotaErr := services.TakeChatQuota(c, userID); quotaErr != nil {
+					err = writeQuotaErrorEvent(conn, event.ID, quotaErr)
+				} else if event.Type == models.EventRegenerate {
+					err = handleRegenerate(c, conn, state, userID, sessionID, event)
+				} else {
+					err = handleEditMessage(c, conn, state, userID, sessionID, event)
+				}
+			default:
+				err = writeErrorEvent(conn, event.ID, models.ErrorCodeBadRequest,
+					fmt.Sprintf("unsupported event type %q", event.Type))
+			}
+		}
 		if err != nil {
-			log.Printf("makeChatRequests error: %v", err)
+			log.Println("ws:", err)
 			break
 		}
+	}
+}
 
-		// Save the user message and the response to the database
-		if err := services.SaveMessage(
-			userID, sessionID, models.Message{Sender: "user", Content: string(message)},
-		); err != nil {
-			log.Printf("error saving user message: %v", err)
-		}
-		if err := services.SaveMessage(
-			userID, sessionID, models.Message{Sender: "model", Content: response},
-		); err != nil {
-			log.Printf("error saving response message: %v", err)
+// forwardJobs writes job updates to the WebSocket until the subscription ends
+func forwardJobs(conn *eventConn, jobs <-chan *models.Job) {
+	for job := range jobs {
+		if err := writeEvent(conn, models.EventJob, "", job); err != nil {
+			log.Println("write:", err)
 		}
+	}
+}
 
-		// Send the response back to the WebSocket client
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(response)); err != nil {
-			log.Println("write:", err)
-			break
+// chatState is the model chat of a WebSocket connection
+type chatState struct {
+	chat services.ChatSession
+	// lastAttachment is the last session file in the chat history
+	lastAttachment int64
+}
+
+// handleUserMessage acknowledges a user_message event, streams the model reply
+// and saves both turns. Files added to the session since the last message are
+// sent along with it. A message with a parent forks the story from there.
+func handleUserMessage(
+	ctx context.Context,
+	conn *eventConn,
+	state *chatState,
+	userID, sessionID string,
+	event models.Event,
+) error {
+	chat := state.chat
+	message := models.UserMessageEvent{}
+	if err := json.Unmarshal(event.Data, &message); err != nil || message.Text == "" {
+		return writeErrorEvent(conn, event.ID, models.ErrorCodeBadRequest, "user_message requires text")
+	}
+	if err := writeEvent(conn, models.EventAck, event.ID, nil); err != nil {
+		return err
+	}
+	if message.ParentID != "" {
+		rewind, err := services.PrepareFork(ctx, userID, sessionID, message.ParentID, message.Text)
+		return sendRewind(ctx, conn, state, userID, sessionID, event.ID, rewind, err)
+	}
+
+	attached, lastAttachment, err := services.LoadNewAttachments(ctx, userID, sessionID, state.lastAttachment)
+	if err != nil {
+		return writeErrorEvent(conn, event.ID, models.ErrorCodeInternal, err.Error())
+	}
+	parts := append(attached, genai.Text(message.Text))
+
+	response, ok, err := sendTurn(ctx, conn, chat, userID, sessionID, event.ID, chat.History(), parts)
+	if !ok {
+		return err
+	}
+	state.lastAttachment = lastAttachment
+
+	// Save the user message and the response to the database
+	if err := services.SaveMessage(
+		userID, sessionID, models.Message{Sender: "user", Content: message.Text},
+	); err != nil {
+		log.Printf("error saving user message: %v", err)
+	}
+	if err := services.SaveMessage(
+		userID, sessionID, models.Message{Sender: "model", Content: response},
+	); err != nil {
+		log.Printf("error saving response message: %v", err)
+	}
+	rebuildLongHistory(ctx, state, userID, sessionID)
+
+	// Tell the client the reply is complete
+	return writeEvent(conn, models.EventModelDone, event.ID, models.ModelDoneEvent{Text: response})
+}
+
+// handleRegenerate replaces the last model reply with a new one to the same
+// user message
+func handleRegenerate(
+	ctx context.Context,
+	conn *eventConn,
+	state *chatState,
+	userID, sessionID string,
+	event models.Event,
+) error {
+	if err := writeEvent(conn, models.EventAck, event.ID, nil); err != nil {
+		return err
+	}
+	rewind, err := services.PrepareRegenerate(ctx, userID, sessionID)
+	return sendRewind(ctx, conn, state, userID, sessionID, event.ID, rewind, err)
+}
+
+// handleEditMessage sends a new version of a past user message on a new
+// branch and streams the reply to it
+func handleEditMessage(
+	ctx context.Context,
+	conn *eventConn,
+	state *chatState,
+	userID, sessionID string,
+	event models.Event,
+) error {
+	edit := models.EditMessageEvent{}
+	if err := json.Unmarshal(event.Data, &edit); err != nil || edit.MessageID == "" || strings.TrimSpace(edit.Text) == "" {
+		return writeErrorEvent(conn, event.ID, models.ErrorCodeBadRequest, "edit_message requires message_id and text")
+	}
+	if err := writeEvent(conn, models.EventAck, event.ID, nil); err != nil {
+		return err
+	}
+	rewind, err := services.PrepareEdit(ctx, userID, sessionID, edit.MessageID, edit.Text)
+	return sendRewind(ctx, conn, state, userID, sessionID, event.ID, rewind, err)
+}
+
+// sendRewind sends a rewound turn from its point of the conversation and
+// saves it as the new active branch
+func sendRewind(
+	ctx context.Context,
+	conn *eventConn,
+	state *chatState,
+	userID, sessionID, replyTo string,
+	rewind *services.Rewind,
+	err error,
+) error {
+	if err != nil {
+		code := models.ErrorCodeInternal
+		switch err {
+		case services.ErrMessageNotFound:
+			code = models.ErrorCodeNotFound
+		case services.ErrNotUserMessage, services.ErrNotModelMessage, services.ErrNothingToRegenerate:
+			code = models.ErrorCodeBadRequest
 		}
+		return writeErrorEvent(conn, replyTo, code, err.Error())
+	}
+
+	chat := state.chat
+	restore := chat.History()
+	chat.SetHistory(rewind.History)
+	response, ok, err := sendTurn(ctx, conn, chat, userID, sessionID, replyTo, restore,
+		[]genai.Part{genai.Text(rewind.Text)})
+	if !ok {
+		return err
+	}
+	if err := rewind.Commit(response); err != nil {
+		log.Printf("error saving rewound turn: %v", err)
+		chat.SetHistory(restore)
+		return writeErrorEvent(conn, replyTo, models.ErrorCodeInternal, err.Error())
 	}
+	state.lastAttachment = rewind.LastAttachment
+	rebuildLongHistory(ctx, state, userID, sessionID)
+
+	return writeEvent(conn, models.EventModelDone, replyTo, models.ModelDoneEvent{Text: response})
 }
 
-// makeChatRequests send chat request to the Gemini model
-func makeChatRequests(ctx context.Context, chat *genai.ChatSession, message string) (string, error) {
-	r, err := chat.SendMessage(ctx, genai.Text(message))
+// sendTurn streams the reply to parts, sent with the trailing user turn of
+// the history, like files no reply was given to yet, so user and model turns
+// keep alternating. On failure the chat goes back to restore and the client
+// is told; ok is false then and err is only set when telling the client
+// failed, which closes the connection.
+func sendTurn(
+	ctx context.Context,
+	conn *eventConn,
+	chat services.ChatSession,
+	userID, sessionID, replyTo string,
+	restore []*genai.Content,
+	parts []genai.Part,
+) (string, bool, error) {
+	history := chat.History()
+	if n := len(history); n > 0 && history[n-1].Role == "user" {
+		parts = append(append([]genai.Part{}, history[n-1].Parts...), parts...)
+		chat.SetHistory(append([]*genai.Content{}, history[:n-1]...))
+	}
+
+	// Stream the reply to the client chunk by chunk
+	response, usage, err := streamChatResponse(ctx, conn, chat, replyTo, parts)
+	services.RecordUsage(userID, sessionID, services.UsageChat, usage)
 	if err != nil {
-		return "", err
+		// Forget the failed turn so the next message starts from a clean history
+		chat.SetHistory(restore)
+		// The turn failed, not the connection, the client may send again
+		writeErr := writeErrorEvent(conn, replyTo, services.GenerationErrorCode(err), err.Error())
+		return "", false, writeErr
 	}
-	return parseContentResponse(r)
+	return response, true, nil
 }
 
-func parseContentResponse(r *genai.GenerateContentResponse) (string, error) {
-	part := r.Candidates[0].Content.Parts[0]
-	value := reflect.ValueOf(part)
-	if value.Kind() == reflect.String {
-		return value.String(), nil
-	} else {
-		return "", fmt.Errorf("not found response text")
+// rebuildLongHistory reloads a chat history that outgrew the context window
+// from the database, which summarizes the oldest turns
+func rebuildLongHistory(ctx context.Context, state *chatState, userID, sessionID string) {
+	if !services.HistoryExceedsBudget(ctx, state.chat.History()) {
+		return
+	}
+	history, lastAttachment, err := services.LoadChatHistory(ctx, userID, sessionID)
+	if err != nil {
+		log.Printf("error rebuilding chat history: %v", err)
+		return
+	}
+	state.chat.SetHistory(history)
+	state.lastAttachment = lastAttachment
+}
+
+// handleSwitchBranch moves the conversation to the branch through a message
+// and sends the client its history
+func handleSwitchBranch(
+	ctx context.Context,
+	conn *eventConn,
+	state *chatState,
+	userID, sessionID string,
+	event models.Event,
+) error {
+	target := models.SwitchBranchEvent{}
+	if err := json.Unmarshal(event.Data, &target); err != nil || target.MessageID == "" {
+		return writeErrorEvent(conn, event.ID, models.ErrorCodeBadRequest, "switch_branch requires message_id")
+	}
+	if err := services.SwitchBranch(userID, sessionID, target.MessageID); err != nil {
+		code := models.ErrorCodeInternal
+		if err == services.ErrMessageNotFound {
+			code = models.ErrorCodeNotFound
+		}
+		return writeErrorEvent(conn, event.ID, code, err.Error())
+	}
+	history, lastAttachment, err := services.LoadChatHistory(ctx, userID, sessionID)
+	if err != nil {
+		return writeErrorEvent(conn, event.ID, models.ErrorCodeInternal, err.Error())
+	}
+	state.chat.SetHistory(history)
+	state.lastAttachment = lastAttachment
+	return writeEvent(conn, models.EventHistory, event.ID, models.HistoryEvent{Messages: historyMessages(history)})
+}
+
+// streamChatResponse sends the message parts to the model and writes each chunk of
+// the reply to the WebSocket as it arrives. It returns the complete reply and
+// the usage of the last chunk that reported it, also when the reply failed.
+func streamChatResponse(
+	ctx context.Context,
+	conn *eventConn,
+	chat services.ChatSession,
+	replyTo string,
+	parts []genai.Part,
+) (string, *genai.UsageMetadata, error) {
+	iter := chat.SendMessageStream(ctx, parts...)
+	defer iter.Close()
+	var reply strings.Builder
+	var usage *genai.UsageMetadata
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return "", usage, err
+		}
+		if resp.UsageMetadata != nil {
+			usage = resp.UsageMetadata
+		}
+
+		if err := services.CheckResponse(resp); err != nil {
+			return "", usage, err
+		}
+		chunk := services.ResponseText(resp)
+		if chunk == "" {
+			continue
+		}
+		reply.WriteString(chunk)
+		if err := writeEvent(conn, models.EventModelChunk, replyTo, models.ModelChunkEvent{Text: chunk}); err != nil {
+			return "", usage, err
+		}
 	}
+	if strings.TrimSpace(reply.String()) == "" {
+		return "", usage, &services.GenerationError{Err: services.ErrResponseEmpty}
+	}
+	return reply.String(), usage, nil
 }
 
+// GetChatHistory lists the stories of the user one page at a time. The
+// pages sorted by last_activity are not a snapshot: a story active after
+// the first page was listed moves and may be seen twice or not at all.
 func GetChatHistory(c *gin.Context) {
-	user_id := c.Query("user_id")
-	stories, err := services.GetStories(user_id)
+	user_id := middlewares.UserID(c)
+
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+
+	order := c.DefaultQuery("order", "desc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid order"})
+		return
+	}
+
+	page, err := services.ListStories(user_id, services.StoryListOptions{
+		Sort:   c.Query("sort"),
+		Asc:    order == "asc",
+		Limit:  limit,
+		Cursor: c.Query("cursor"),
+	})
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if errors.Is(err, services.ErrInvalidCursor) || errors.Is(err, services.ErrInvalidSort) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
-	c.JSON(http.StatusOK, gin.H{"stories": stories})
+	c.JSON(http.StatusOK, page)
 }
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// parseUsageTime accepts a date or an RFC 3339 time. dateOnly tells a date
+// was given.
+func parseUsageTime(value string) (t time.Time, dateOnly bool, err error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// GetUsage returns the daily and monthly model usage of the user. By default
+// the daily rollup covers the last 30 days and the monthly one the last 12
+// months, from and to narrow both. A date given as to is included, a time
+// is not.
+func GetUsage(c *gin.Context) {
+	userID := middlewares.UserID(c)
+
+	now := time.Now().UTC()
+	to := now
+	dailyFrom := now.AddDate(0, 0, -30)
+	monthlyFrom := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -11, 0)
+
+	if value := c.Query("from"); value != "" {
+		from, _, err := parseUsageTime(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from"})
+			return
+		}
+		dailyFrom, monthlyFrom = from, from
+	}
+	if value := c.Query("to"); value != "" {
+		end, dateOnly, err := parseUsageTime(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to"})
+			return
+		}
+		to = end
+		if dateOnly {
+			to = end.AddDate(0, 0, 1)
+		}
+	}
+
+	daily, err := services.GetUsage(userID, services.UsageDaily, dailyFrom, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	monthly, err := services.GetUsage(userID, services.UsageMonthly, monthlyFrom, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"daily": daily, "monthly": monthly})
+}
@@ -19,9 +19,25 @@ func init() {
 	}
 	// scripts.SeedData()
 	models.InitDB()
-	err = services.CreateGenAIClient()
+	err = services.CreateBlobStore()
 	if err != nil {
-		log.Fatalf("can not create genai client: %v", err)
+		log.Fatalf("can not create blob store: %v", err)
+	}
+	err = services.CreateQuotaStore()
+	if err != nil {
+		log.Fatalf("can not create quota store: %v", err)
+	}
+	err = services.LoadStoryStyles()
+	if err != nil {
+		log.Fatalf("can not load story styles: %v", err)
+	}
+	err = services.CreateStoryGenerator()
+	if err != nil {
+		log.Fatalf("can not create story generator: %v", err)
+	}
+	err = services.StartJobWorkers()
+	if err != nil {
+		log.Fatalf("can not start job workers: %v", err)
 	}
 }
 
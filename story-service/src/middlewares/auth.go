@@ -8,11 +8,20 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// UserIDKey is the gin context key of the authenticated user's ID
+const UserIDKey = "user_id"
+
 type Claims struct {
-	Email string
+	UserID string
+	Email  string
 	jwt.RegisteredClaims
 }
 
+// UserID returns the ID of the authenticated user of the request
+func UserID(c *gin.Context) string {
+	return c.GetString(UserIDKey)
+}
+
 func AuthMiddleware(c *gin.Context) {
 	signedToken, err := c.Cookie("token")
 	if err != nil {
@@ -39,6 +48,12 @@ func AuthMiddleware(c *gin.Context) {
 		return
 	}
 
+	if claims.UserID == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token has no user id!"})
+		return
+	}
+
+	c.Set(UserIDKey, claims.UserID)
 	c.Set("email", claims.Email)
 
 	c.Next()
@@ -0,0 +1,176 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// IdempotencyKeyHeader lets clients retry a request without running it twice
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency replays the stored response of a request made again with the
+// same Idempotency-Key by the same user. A retry sent while the request is
+// still running waits for it, and gets 409 when it runs too long. The key
+// used with another method, path or body gets 422. Only successful
+// responses are stored, a failed request can be retried with its key.
+// Request bodies are limited to services.MaxUploadSize.
+func Idempotency(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, services.MaxUploadSize)
+	key := c.GetHeader(IdempotencyKeyHeader)
+	if key == "" {
+		c.Next()
+		return
+	}
+	userID := UserID(c)
+
+	hash, cleanup, err := requestHash(c.Request)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer cleanup()
+
+	stored, err := services.BeginIdempotentRequest(c.Request.Context(), userID, key, hash)
+	if err != nil {
+		switch err {
+		case services.ErrInvalidIdempotencyKey:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case services.ErrIdempotencyKeyInUse:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case services.ErrIdempotencyKeyMismatch:
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		default:
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	if stored != nil {
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(stored.Status, stored.ContentType, stored.Body)
+		c.Abort()
+		return
+	}
+
+	// The key is released unless the response is stored, also on a panic
+	saved := false
+	defer func() {
+		if saved {
+			return
+		}
+		if err := services.ReleaseIdempotencyKey(userID, key); err != nil {
+			log.Printf("error releasing idempotency key: %v", err)
+		}
+	}()
+
+	writer := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+
+	status := writer.Status()
+	if status < http.StatusOK || status >= http.StatusMultipleChoices {
+		return
+	}
+	err = services.SaveIdempotentResponse(userID, key, services.IdempotentResponse{
+		Status:      status,
+		ContentType: writer.Header().Get("Content-Type"),
+		Body:        writer.body.Bytes(),
+	})
+	if err != nil {
+		log.Printf("error saving idempotent response: %v", err)
+		return
+	}
+	saved = true
+}
+
+// requestHash hashes the method, path and body of the request. The body is
+// spooled to a temporary file that replaces it, cleanup removes the file.
+// Multipart forms are hashed by their parts, clients pick a new boundary
+// when they retry.
+func requestHash(r *http.Request) (string, func(), error) {
+	body, err := os.CreateTemp("", "idempotency-*")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		body.Close()
+		os.Remove(body.Name())
+	}
+	if _, err := io.Copy(body, r.Body); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	r.Body.Close()
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.Path)
+	if err := hashBody(h, r.Header.Get("Content-Type"), body); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	r.Body = body
+	return hex.EncodeToString(h.Sum(nil)), cleanup, nil
+}
+
+func hashBody(h io.Writer, contentType string, body io.Reader) error {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	if mediaType != "multipart/form-data" || params["boundary"] == "" {
+		_, err := io.Copy(h, body)
+		return err
+	}
+	form := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %q %q\n", part.FormName(), part.FileName(), part.Header.Get("Content-Type"))
+		if _, err := io.Copy(h, part); err != nil {
+			return err
+		}
+		fmt.Fprint(h, "\n")
+	}
+}
@@ -0,0 +1,53 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/services"
+)
+
+// RetryAfterSeconds rounds the wait of a quota error up to whole seconds
+func RetryAfterSeconds(err *services.QuotaError) int {
+	return int(math.Ceil(err.RetryAfter.Seconds()))
+}
+
+// UploadQuota reserves an upload of the user before the handler runs, so
+// concurrent uploads cannot all pass the limit. Uploads the handler does not
+// accept are given back.
+func UploadQuota(c *gin.Context) {
+	userID := UserID(c)
+	reservedAt := time.Now()
+	if err := services.TakeUploadQuota(c, userID); err != nil {
+		abortQuota(c, err)
+		return
+	}
+
+	c.Next()
+
+	if status := c.Writer.Status(); status < http.StatusOK || status >= http.StatusMultipleChoices {
+		services.RefundUpload(context.WithoutCancel(c), userID, reservedAt)
+	}
+}
+
+func abortQuota(c *gin.Context, err error) {
+	var quotaErr *services.QuotaError
+	if !errors.As(err, &quotaErr) {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	retryAfter := RetryAfterSeconds(quotaErr)
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error":       quotaErr.Error(),
+		"code":        models.ErrorCodeQuotaExceeded,
+		"limit":       quotaErr.Limit,
+		"retry_after": retryAfter,
+	})
+}
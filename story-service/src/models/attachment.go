@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Attachment is a file of a session. Attachments are numbered in upload
+// order and labeled that way in the model history.
+type Attachment struct {
+	ID          int64         `json:"id"`
+	SessionID   string        `json:"session_id"`
+	Position    int           `json:"position"`
+	Label       string        `json:"label"`
+	Filename    string        `json:"filename"`
+	ContentType string        `json:"content_type"`
+	Size        int64         `json:"size"`
+	UploadedAt  time.Time     `json:"uploaded_at"`
+	Metadata    *FileMetadata `json:"metadata,omitempty"`
+}
+
+// FileMetadata is what a file tells about itself: EXIF of photos and the
+// info dictionary of PDFs
+type FileMetadata struct {
+	TakenAt   *time.Time `json:"taken_at,omitempty"`
+	Camera    string     `json:"camera,omitempty"`
+	Latitude  *float64   `json:"latitude,omitempty"`
+	Longitude *float64   `json:"longitude,omitempty"`
+	Author    string     `json:"author,omitempty"`
+	Title     string     `json:"title,omitempty"`
+	Pages     int        `json:"pages,omitempty"`
+}
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventProtocolVersion is the version of the /api/story/ws message schema.
+// It is bumped on any incompatible change to the events below.
+const EventProtocolVersion = 1
+
+type EventType string
+
+const (
+	// EventHistory is sent by the server once after connecting.
+	EventHistory EventType = "history"
+	// EventUserMessage is sent by the client to add a user turn.
+	EventUserMessage EventType = "user_message"
+	// EventModelChunk carries a piece of the streamed model reply.
+	EventModelChunk EventType = "model_chunk"
+	// EventModelDone marks the end of a model reply and carries its full text.
+	EventModelDone EventType = "model_done"
+	// EventError reports a failure, optionally tied to a client event.
+	EventError EventType = "error"
+	// EventAck confirms the server received a client event.
+	EventAck EventType = "ack"
+	// EventPing is a keep-alive. The server answers a client ping with a ping.
+	EventPing EventType = "ping"
+	// EventJob carries the status of an upload job of the session.
+	EventJob EventType = "job"
+	// EventRegenerate is sent by the client to replace the last model reply.
+	EventRegenerate EventType = "regenerate"
+	// EventEditMessage is sent by the client to change a past user message.
+	// The conversation goes on from there on a new branch.
+	EventEditMessage EventType = "edit_message"
+	// EventSwitchBranch is sent by the client to continue the conversation
+	// on the branch through a message. The server answers with the history.
+	EventSwitchBranch EventType = "switch_branch"
+)
+
+// Event is the envelope of every WebSocket frame in both directions.
+type Event struct {
+	Version   int             `json:"version"`
+	Type      EventType       `json:"type"`
+	ID        string          `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	ReplyTo   string          `json:"reply_to,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+type HistoryEvent struct {
+	Messages []HistoryMessage `json:"messages"`
+}
+
+// HistoryMessage is one turn of the conversation. Media turns carry the
+// uploaded file instead of text.
+type HistoryMessage struct {
+	Role  string      `json:"role"`
+	Text  string      `json:"text,omitempty"`
+	Media *MediaEvent `json:"media,omitempty"`
+}
+
+type MediaEvent struct {
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+type UserMessageEvent struct {
+	Text string `json:"text"`
+	// ParentID forks the story from an earlier message instead of the end
+	// of the active branch
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+type EditMessageEvent struct {
+	MessageID string `json:"message_id"`
+	Text      string `json:"text"`
+}
+
+type SwitchBranchEvent struct {
+	MessageID string `json:"message_id"`
+}
+
+type ModelChunkEvent struct {
+	Text string `json:"text"`
+}
+
+type ModelDoneEvent struct {
+	Text string `json:"text"`
+}
+
+type ErrorCode string
+
+const (
+	ErrorCodeBadRequest         ErrorCode = "bad_request"
+	ErrorCodeUnsupportedVersion ErrorCode = "unsupported_version"
+	ErrorCodeNotFound           ErrorCode = "not_found"
+	ErrorCodeInternal           ErrorCode = "internal"
+	ErrorCodeGeneration         ErrorCode = "generation_failed"
+	ErrorCodeBlocked            ErrorCode = "blocked"
+	ErrorCodeRecitation         ErrorCode = "recitation"
+	ErrorCodeMaxTokens          ErrorCode = "max_tokens"
+	ErrorCodeEmptyResponse      ErrorCode = "empty_response"
+	ErrorCodeQuotaExceeded      ErrorCode = "quota_exceeded"
+)
+
+type ErrorEvent struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// Limit and RetryAfter, in seconds, are set on quota_exceeded errors
+	Limit      string `json:"limit,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
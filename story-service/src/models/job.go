@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Job is the story generation of an uploaded file, run in the background.
+type Job struct {
+	ID        string    `json:"id"`
+	SessionID string    `json:"session_id"`
+	Status    JobStatus `json:"status"`
+	Story     *Message  `json:"story,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+	Attempts  int       `json:"attempts"`
+	// Progress is set for jobs done in parts, like long PDFs
+	Progress  *JobProgress `json:"progress,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Session is a story conversation owned by a user.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Title     string    `json:"title"`
+	FileID    *int64    `json:"file_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
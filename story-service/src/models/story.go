@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type Story struct {
 	ID      string `json:"id"`
 	Content string `json:"content"`
@@ -10,4 +12,32 @@ type Message struct {
 	ID      string `json:"id"`
 	Sender  string `json:"sender"`
 	Content string `json:"content"`
+	// ParentID is the message this one follows, empty for the first message
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+// MessageNode is a message in the tree of a session. Active messages make up
+// the branch the conversation goes on from. Regenerating a reply or editing a
+// prompt starts a new branch, which keeps the replaced messages.
+type MessageNode struct {
+	Message
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StorySummary is one entry of the story listing
+type StorySummary struct {
+	SessionID    string    `json:"session_id"`
+	Title        string    `json:"title"`
+	Preview      string    `json:"preview"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	MessageCount int       `json:"message_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+type StoryPage struct {
+	Stories    []*StorySummary `json:"stories"`
+	NextCursor string          `json:"next_cursor,omitempty"`
 }
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// UsageRollup is the model usage of a user over one day or month
+type UsageRollup struct {
+	PeriodStart     time.Time `json:"period_start"`
+	Requests        int64     `json:"requests"`
+	PromptTokens    int64     `json:"prompt_tokens"`
+	CandidateTokens int64     `json:"candidate_tokens"`
+	TotalTokens     int64     `json:"total_tokens"`
+	Cost            float64   `json:"cost"`
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/handlers"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/middlewares"
 
 	"github.com/gin-gonic/gin"
 )
@@ -9,8 +10,26 @@ import (
 func SetupRouter(r *gin.Engine) {
 	api := r.Group("/api")
 	{
-		api.POST("/upload", handlers.UploadData)
+		api.POST("/upload", middlewares.Idempotency, middlewares.UploadQuota, handlers.UploadData)
+		api.POST("/albums", middlewares.Idempotency, middlewares.UploadQuota, handlers.UploadAlbum)
+		api.GET("/styles", handlers.GetStoryStyles)
 		api.GET("/story/ws", handlers.WsHandler)
 		api.GET("/stories", handlers.GetChatHistory)
+		api.GET("/usage", handlers.GetUsage)
+		api.GET("/preferences/metadata", handlers.GetMetadataPreferences)
+		api.PUT("/preferences/metadata", handlers.UpdateMetadataPreferences)
+		api.GET("/jobs/:id", handlers.GetJob)
+
+		api.POST("/sessions", handlers.CreateSession)
+		api.GET("/sessions", handlers.ListSessions)
+		api.GET("/sessions/:id", handlers.GetSession)
+		api.PATCH("/sessions/:id", handlers.UpdateSession)
+		api.DELETE("/sessions/:id", handlers.DeleteSession)
+		api.GET("/sessions/:id/files", handlers.ListSessionFiles)
+		api.POST("/sessions/:id/files", middlewares.Idempotency, middlewares.UploadQuota, handlers.AddSessionFile)
+		api.GET("/sessions/:id/messages", handlers.ListSessionMessages)
+		api.GET("/sessions/:id/tree", handlers.GetMessageTree)
+		api.GET("/sessions/:id/export", handlers.ExportSession)
+		api.GET("/sessions/:id/messages/:messageId/versions", handlers.ListMessageVersions)
 	}
 }
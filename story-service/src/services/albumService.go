@@ -0,0 +1,218 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const (
+	MaxAlbumImages = 50
+	// maxAlbumSize bounds the total size of the images of an album, also
+	// after unpacking zip archives
+	maxAlbumSize = 200 << 20
+)
+
+var ErrInvalidAlbum = errors.New("invalid album")
+
+// AlbumImage is a photo of an album upload
+type AlbumImage struct {
+	Filename string
+	MIMEType string
+	Data     []byte
+	// TakenAt is the EXIF capture time, zero when the photo has none
+	TakenAt time.Time
+}
+
+// ReadAlbumImages reads the images of an album upload. Zip archives are
+// unpacked and files in them that are not images are skipped.
+func ReadAlbumImages(files []*multipart.FileHeader) ([]*AlbumImage, error) {
+	images := []*AlbumImage{}
+	budget := int64(maxAlbumSize)
+	for _, file := range files {
+		unpacked, err := readAlbumFile(file, &budget)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, unpacked...)
+	}
+
+	if len(images) == 0 {
+		return nil, fmt.Errorf("%w: no images", ErrInvalidAlbum)
+	}
+	if len(images) > MaxAlbumImages {
+		return nil, fmt.Errorf("%w: more than %d images", ErrInvalidAlbum, MaxAlbumImages)
+	}
+	return images, nil
+}
+
+// readAlbumFile reads an uploaded photo, or the photos of an uploaded zip
+// archive. Archives are read in place from the upload, only the photos in
+// them take from the budget.
+func readAlbumFile(file *multipart.FileHeader, budget *int64) ([]*AlbumImage, error) {
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	detected, err := mimetype.DetectReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if detected.Is("application/zip") {
+		return readZipImages(f, file.Size, budget)
+	}
+
+	data, err := readLimited(f, file.Size, budget)
+	if err != nil {
+		return nil, err
+	}
+	image, err := newAlbumImage(file.Filename, data)
+	if err != nil {
+		return nil, err
+	}
+	return []*AlbumImage{image}, nil
+}
+
+func readZipImages(r io.ReaderAt, size int64, budget *int64) ([]*AlbumImage, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAlbum, err)
+	}
+	images := []*AlbumImage{}
+	for _, entry := range archive.File {
+		name := entry.Name
+		if entry.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		r, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidAlbum, err)
+		}
+		content, err := readLimited(r, int64(entry.UncompressedSize64), budget)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		image, err := newAlbumImage(path.Base(name), content)
+		if err != nil {
+			log.Printf("skipping %s of album archive: %v", name, err)
+			continue
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// readLimited reads r and takes its size from the budget, failing once the
+// budget is used up whatever size r claims to have
+func readLimited(r io.Reader, size int64, budget *int64) ([]byte, error) {
+	if size > *budget {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrInvalidAlbum, maxAlbumSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, *budget+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > *budget {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrInvalidAlbum, maxAlbumSize)
+	}
+	*budget -= int64(len(data))
+	return data, nil
+}
+
+func newAlbumImage(filename string, data []byte) (*AlbumImage, error) {
+	mimeType, err := DetectMediaType(data, filename)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, fmt.Errorf("%w: %s is not an image", ErrUnsupportedMediaType, filename)
+	}
+	image := &AlbumImage{Filename: filename, MIMEType: mimeType, Data: data}
+	if x, err := exif.Decode(bytes.NewReader(data)); err == nil {
+		if takenAt, err := x.DateTime(); err == nil {
+			image.TakenAt = takenAt
+		}
+	}
+	return image, nil
+}
+
+// OrderAlbumImages sorts the images by capture time. Images without one
+// follow in upload order.
+func OrderAlbumImages(images []*AlbumImage) {
+	sort.SliceStable(images, func(i, j int) bool {
+		a, b := images[i].TakenAt, images[j].TakenAt
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero() && b.IsZero()
+		}
+		return a.Before(b)
+	})
+}
+
+// SaveAlbumImages saves the images as files of the session in their order.
+// When one fails, the ones already saved are removed.
+func SaveAlbumImages(ctx context.Context, userID, sessionID string, images []*AlbumImage) ([]int64, error) {
+	fileIDs := []int64{}
+	for _, image := range images {
+		id, err := saveFile(ctx, userID, sessionID, image.Filename, bytes.NewReader(image.Data), int64(len(image.Data)), image.MIMEType)
+		if err != nil {
+			if discardErr := DiscardUpload(ctx, userID, sessionID, fileIDs, false); discardErr != nil {
+				log.Printf("could not discard files %v: %v", fileIDs, discardErr)
+			}
+			return nil, err
+		}
+		fileIDs = append(fileIDs, id)
+	}
+	return fileIDs, nil
+}
+
+// generateAlbumContent generates one story from several files of the
+// session, each labeled the way it is in the chat history
+func generateAlbumContent(
+	ctx context.Context,
+	userID, sessionID string,
+	fileIDs []int64,
+	prompt *StoryPrompt,
+) (*genai.GenerateContentResponse, error) {
+	attachments, err := listAttachments(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int64]*sessionAttachment{}
+	for _, a := range attachments {
+		byID[a.ID] = a
+	}
+
+	parts := []genai.Part{genai.Text(prompt.Text)}
+	for _, id := range fileIDs {
+		a, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("file %d of the album is missing", id)
+		}
+		p, err := attachmentParts(ctx, userID, a)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p...)
+	}
+	return Generator.GenerateContent(ctx, prompt.Config, parts...)
+}
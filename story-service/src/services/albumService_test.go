@@ -0,0 +1,87 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLimited(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		size       int64
+		budget     int64
+		wantErr    bool
+		wantBudget int64
+	}{
+		{name: "within the budget", content: "abc", size: 3, budget: 10, wantBudget: 7},
+		{name: "uses the whole budget", content: "abc", size: 3, budget: 3, wantBudget: 0},
+		{name: "claims to be too large", content: "abc", size: 11, budget: 10, wantErr: true, wantBudget: 10},
+		{name: "larger than it claims", content: strings.Repeat("a", 11), size: 1, budget: 10, wantErr: true, wantBudget: 10},
+		{name: "smaller than it claims", content: "ab", size: 5, budget: 10, wantBudget: 8},
+		{name: "empty", content: "", size: 0, budget: 0, wantBudget: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := tt.budget
+			data, err := readLimited(strings.NewReader(tt.content), tt.size, &budget)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAlbum) {
+					t.Fatalf("error = %v, want %v", err, ErrInvalidAlbum)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if string(data) != tt.content {
+				t.Errorf("data = %q, want %q", data, tt.content)
+			}
+			if budget != tt.wantBudget {
+				t.Errorf("budget = %d, want %d", budget, tt.wantBudget)
+			}
+		})
+	}
+}
+
+func TestOrderAlbumImages(t *testing.T) {
+	at := func(hour int) time.Time { return time.Date(2024, 7, 1, hour, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name   string
+		images []*AlbumImage
+		want   []string
+	}{
+		{
+			name:   "by capture time",
+			images: []*AlbumImage{{Filename: "c", TakenAt: at(12)}, {Filename: "a", TakenAt: at(8)}, {Filename: "b", TakenAt: at(10)}},
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "images without a time follow in upload order",
+			images: []*AlbumImage{{Filename: "x"}, {Filename: "b", TakenAt: at(10)}, {Filename: "y"}, {Filename: "a", TakenAt: at(8)}},
+			want:   []string{"a", "b", "x", "y"},
+		},
+		{
+			name:   "same time keeps upload order",
+			images: []*AlbumImage{{Filename: "b", TakenAt: at(9)}, {Filename: "a", TakenAt: at(9)}},
+			want:   []string{"b", "a"},
+		},
+		{
+			name:   "no times",
+			images: []*AlbumImage{{Filename: "b"}, {Filename: "a"}},
+			want:   []string{"b", "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			OrderAlbumImages(tt.images)
+			got := []string{}
+			for _, image := range tt.images {
+				got = append(got, image.Filename)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
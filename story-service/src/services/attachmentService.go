@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+var ErrFileNotFound = errors.New("file not found")
+
+// sessionAttachment is an attachment with the last message sent before it,
+// which places it in the history, the metadata the user lets into prompts
+// and its parts once loaded
+type sessionAttachment struct {
+	*models.Attachment
+	afterMessageID int64
+	details        string
+	// pageNotes replace a long PDF, which does not fit in the chat history
+	pageNotes string
+	// hasText is set for written documents, whose text replaces the file
+	hasText bool
+	parts   []genai.Part
+}
+
+// attachmentKind names a media type the way users refer to it
+func attachmentKind(mimeType string) string {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return "photo"
+	case mimeType == "application/pdf" || isTextDocument(mimeType):
+		return "document"
+	case strings.HasPrefix(mimeType, "video/"):
+		return "video"
+	case strings.HasPrefix(mimeType, "audio/"):
+		return "recording"
+	default:
+		return "file"
+	}
+}
+
+// listAttachments returns the files of the session in upload order, labeled
+// with their position and their number among files of the same kind
+func listAttachments(userID, sessionID string) ([]*sessionAttachment, error) {
+	return listAttachmentsThrough(userID, sessionID, math.MaxInt64)
+}
+
+// listAttachmentsThrough is listAttachments for the files up to lastID
+func listAttachmentsThrough(userID, sessionID string, lastID int64) ([]*sessionAttachment, error) {
+	optOut, err := GetMetadataOptOut(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `SELECT id, session_id, filename, content_type, COALESCE(size, 0), upload_date, metadata,
+		COALESCE(page_notes, ''), text_content IS NOT NULL, after_message_id
+	FROM session_files WHERE user_id = $1 AND session_id = $2 AND id <= $3 ORDER BY id`
+	rows, err := models.Db.Query(stmt, userID, sessionID, lastID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []*sessionAttachment{}
+	kinds := map[string]int{}
+	for rows.Next() {
+		a := sessionAttachment{Attachment: &models.Attachment{}}
+		uploadedAt := sql.NullTime{}
+		metadata := []byte{}
+		if err := rows.Scan(
+			&a.ID, &a.SessionID, &a.Filename, &a.ContentType, &a.Size, &uploadedAt, &metadata,
+			&a.pageNotes, &a.hasText, &a.afterMessageID,
+		); err != nil {
+			return nil, err
+		}
+		a.UploadedAt = uploadedAt.Time
+		if len(metadata) > 0 {
+			if err := json.Unmarshal(metadata, &a.Metadata); err != nil {
+				return nil, err
+			}
+			a.details = DescribeMetadata(a.Metadata, optOut)
+		}
+		a.Position = len(attachments) + 1
+		kind := attachmentKind(a.ContentType)
+		kinds[kind]++
+		a.Label = fmt.Sprintf("Attachment %d (%s %d, %q)", a.Position, kind, kinds[kind], a.Filename)
+		attachments = append(attachments, &a)
+	}
+	return attachments, rows.Err()
+}
+
+// ListAttachments returns the files of a session in upload order
+func ListAttachments(userID, sessionID string) ([]*models.Attachment, error) {
+	attachments, err := listAttachments(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*models.Attachment, 0, len(attachments))
+	for _, a := range attachments {
+		list = append(list, a.Attachment)
+	}
+	return list, nil
+}
+
+// GetAttachment returns a file of a session with its label. Only the files
+// before it are read to number it.
+func GetAttachment(userID, sessionID string, fileID int64) (*models.Attachment, error) {
+	attachments, err := listAttachmentsThrough(userID, sessionID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(attachments); n > 0 && attachments[n-1].ID == fileID {
+		return attachments[n-1].Attachment, nil
+	}
+	return nil, ErrFileNotFound
+}
+
+// attachmentParts returns the label of the attachment followed by its
+// content, by the text of a written document or by the page notes of a long
+// PDF
+func attachmentParts(ctx context.Context, userID string, a *sessionAttachment) ([]genai.Part, error) {
+	label := a.Label
+	if a.details != "" {
+		label += ", " + a.details
+	}
+	if a.pageNotes != "" {
+		return []genai.Part{genai.Text(label + ", read in parts. " + a.pageNotes)}, nil
+	}
+	if a.hasText {
+		text, err := loadFileText(userID, a.ID)
+		if err != nil {
+			return nil, err
+		}
+		return []genai.Part{genai.Text(label + ":"), genai.Text(text)}, nil
+	}
+
+	data, err := loadFileData(ctx, userID, a.ID)
+	if err != nil {
+		return nil, err
+	}
+	// Older rows hold the content type sent by the client, sniff it instead
+	mimeType := a.ContentType
+	if detected, err := DetectMediaType(data, ""); err == nil {
+		mimeType = detected
+	}
+	return []genai.Part{genai.Text(label + ":"), genai.Blob{MIMEType: mimeType, Data: data}}, nil
+}
+
+// LoadNewAttachments returns the labeled parts of the session's files
+// uploaded after the file afterID, and the ID of the last one
+func LoadNewAttachments(ctx context.Context, userID, sessionID string, afterID int64) ([]genai.Part, int64, error) {
+	attachments, err := listAttachments(userID, sessionID)
+	if err != nil {
+		return nil, afterID, err
+	}
+	parts := []genai.Part{}
+	lastID := afterID
+	for _, a := range attachments {
+		if a.ID <= afterID {
+			continue
+		}
+		p, err := attachmentParts(ctx, userID, a)
+		if err != nil {
+			return nil, afterID, err
+		}
+		parts = append(parts, p...)
+		lastID = a.ID
+	}
+	return parts, lastID, nil
+}
+
+// fileDetails returns the metadata of a file of the session the user lets
+// into prompts
+func fileDetails(userID, sessionID string, fileID int64) (string, error) {
+	attachments, err := listAttachmentsThrough(userID, sessionID, fileID)
+	if err != nil {
+		return "", err
+	}
+	if n := len(attachments); n > 0 && attachments[n-1].ID == fileID {
+		return attachments[n-1].details, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const defaultBlobCacheMB = 256
+
+// cachedBlobStore keeps recently read blobs in memory. Chat histories are
+// rebuilt with every file of the session on each connect, rebuild, edit and
+// fork, and blobs never change once stored. Blobs larger than an eighth of
+// the cache are not kept.
+type cachedBlobStore struct {
+	BlobStore
+
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedBlob struct {
+	key  string
+	data []byte
+}
+
+// newCachedBlobStore wraps store with a cache of BLOB_CACHE_MB megabytes,
+// 0 turns the cache off
+func newCachedBlobStore(store BlobStore) BlobStore {
+	mb := int64(defaultBlobCacheMB)
+	if n, err := strconv.ParseInt(os.Getenv("BLOB_CACHE_MB"), 10, 64); err == nil && n >= 0 {
+		mb = n
+	}
+	if mb == 0 {
+		return store
+	}
+	return &cachedBlobStore{
+		BlobStore: store,
+		maxSize:   mb << 20,
+		order:     list.New(),
+		entries:   map[string]*list.Element{},
+	}
+}
+
+// Get returns a cached blob, or reads it from the store and keeps it. The
+// cached bytes are shared, readers must not change them.
+func (s *cachedBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if data, ok := s.lookup(key); ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	r, err := s.BlobStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s.add(key, data)
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *cachedBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	if e, ok := s.entries[key]; ok {
+		s.removeElement(e)
+	}
+	s.mu.Unlock()
+	return s.BlobStore.Delete(ctx, key)
+}
+
+func (s *cachedBlobStore) lookup(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*cachedBlob).data, true
+}
+
+func (s *cachedBlobStore) add(key string, data []byte) {
+	size := int64(len(data))
+	if size > s.maxSize/8 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; ok {
+		return
+	}
+	s.entries[key] = s.order.PushFront(&cachedBlob{key: key, data: data})
+	s.size += size
+	for s.size > s.maxSize {
+		s.removeElement(s.order.Back())
+	}
+}
+
+func (s *cachedBlobStore) removeElement(e *list.Element) {
+	blob := s.order.Remove(e).(*cachedBlob)
+	delete(s.entries, blob.key)
+	s.size -= int64(len(blob.data))
+}
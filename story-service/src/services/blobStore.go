@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+)
+
+const (
+	BlobStoreLocal = "local"
+	BlobStoreS3    = "s3"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores uploaded media outside of the database
+type BlobStore interface {
+	// Put stores size bytes read from r under key
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the blob stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+var Blobs BlobStore
+
+// CreateBlobStore creates the blob store selected by BLOB_STORE.
+// It defaults to the local filesystem.
+func CreateBlobStore() error {
+	kind := os.Getenv("BLOB_STORE")
+	if kind == "" {
+		kind = BlobStoreLocal
+	}
+
+	var err error
+	switch kind {
+	case BlobStoreLocal:
+		Blobs, err = newLocalBlobStore(os.Getenv("BLOB_STORE_DIR"))
+	case BlobStoreS3:
+		Blobs, err = newS3BlobStore(context.Background())
+	default:
+		return fmt.Errorf("unknown BLOB_STORE %q", kind)
+	}
+	if err != nil {
+		return err
+	}
+	Blobs = newCachedBlobStore(Blobs)
+	log.Printf("using %s blob store", kind)
+	return nil
+}
+
+// newBlobKey returns a unique storage key for a file of the user, the
+// escaped user ID and a random name. Keys do not hold the session ID, so a
+// blob keeps its key when its session changes.
+func newBlobKey(userID, ext string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("users/%s/%s%s", url.PathEscape(userID), hex.EncodeToString(b), url.PathEscape(ext)), nil
+}
+
+// readBlob returns the whole content of a blob
+func readBlob(ctx context.Context, key string) ([]byte, error) {
+	r, err := Blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,331 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"cloud.google.com/go/vertexai/genai"
+	"golang.org/x/net/html"
+)
+
+const (
+	MimeTypeText     = "text/plain"
+	MimeTypeMarkdown = "text/markdown"
+	MimeTypeHTML     = "text/html"
+	MimeTypeDOCX     = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	MimeTypeODT      = "application/vnd.oasis.opendocument.text"
+
+	// maxDocumentSize bounds the written documents read for their text
+	maxDocumentSize = 20 << 20
+	// maxDocumentXML bounds the XML read from a DOCX or ODT archive
+	maxDocumentXML = 64 << 20
+	// maxDocumentText bounds the text kept from a document, which goes into
+	// every prompt of its session
+	maxDocumentText = 1 << 20
+)
+
+var (
+	ErrUnreadableDocument = errors.New("could not read the text of the document")
+	ErrDocumentTooLarge   = errors.New("document is too large")
+)
+
+// isTextDocument reports whether the MIME type is a written document, which
+// is sent to the model as its extracted text
+func isTextDocument(mimeType string) bool {
+	switch mimeType {
+	case MimeTypeText, MimeTypeMarkdown, MimeTypeHTML, MimeTypeDOCX, MimeTypeODT:
+		return true
+	}
+	return false
+}
+
+// ExtractDocumentText returns the normalized text of a written document
+func ExtractDocumentText(data []byte, mimeType string) (string, error) {
+	if len(data) > maxDocumentSize {
+		return "", fmt.Errorf("%w: larger than %d bytes", ErrDocumentTooLarge, maxDocumentSize)
+	}
+	var (
+		text string
+		err  error
+	)
+	switch mimeType {
+	case MimeTypeText, MimeTypeMarkdown:
+		text = decodeText(data)
+	case MimeTypeHTML:
+		text, err = htmlText(decodeText(data))
+	case MimeTypeDOCX:
+		text, err = zipXMLText(data, "word/document.xml", docxElements)
+	case MimeTypeODT:
+		text, err = zipXMLText(data, "content.xml", odtElements)
+	default:
+		return "", fmt.Errorf("%w: %s is not a text document", ErrUnsupportedMediaType, mimeType)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnreadableDocument, err)
+	}
+	text = normalizeText(text)
+	if text == "" {
+		return "", fmt.Errorf("%w: the document is empty", ErrUnreadableDocument)
+	}
+	if len(text) > maxDocumentText {
+		return "", fmt.Errorf("%w: its text is longer than %d bytes", ErrDocumentTooLarge, maxDocumentText)
+	}
+	return text, nil
+}
+
+// documentParts returns the parts that carry the content of a file, the
+// text of a written document or the file itself
+func documentParts(data []byte, mimeType string) ([]genai.Part, error) {
+	if !isTextDocument(mimeType) {
+		return []genai.Part{genai.Blob{MIMEType: mimeType, Data: data}}, nil
+	}
+	text, err := ExtractDocumentText(data, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	return []genai.Part{genai.Text(text)}, nil
+}
+
+// decodeText decodes UTF-16 text with a byte order mark and drops invalid
+// UTF-8 from anything else
+func decodeText(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return decodeUTF16(data[2:], func(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 })
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return decodeUTF16(data[2:], func(b []byte) uint16 { return uint16(b[1]) | uint16(b[0])<<8 })
+	}
+	data = bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF})
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return strings.ToValidUTF8(string(data), "")
+}
+
+func decodeUTF16(data []byte, unit func([]byte) uint16) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, unit(data[i:i+2]))
+	}
+	return string(utf16.Decode(units))
+}
+
+var (
+	trailingSpace = regexp.MustCompile(`[ \t]+\n`)
+	blankLines    = regexp.MustCompile(`\n{3,}`)
+)
+
+// normalizeText unifies line endings, removes control characters and
+// trailing spaces and keeps at most one blank line between paragraphs
+func normalizeText(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r < ' ' || r == '\u007F' || r == '\uFEFF' {
+			return -1
+		}
+		return r
+	}, text)
+	text = trailingSpace.ReplaceAllString(text+"\n", "\n")
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
+
+// htmlBlocks are the elements that start a new line of text
+var htmlBlocks = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true,
+	"dd": true, "div": true, "dl": true, "dt": true, "figcaption": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "main": true, "nav": true, "ol": true,
+	"p": true, "pre": true, "section": true, "table": true, "tr": true, "ul": true,
+}
+
+// htmlSkipped are the elements whose content is not text of the page
+var htmlSkipped = map[string]bool{
+	"head": true, "noscript": true, "script": true, "style": true, "svg": true, "template": true,
+}
+
+var htmlSpace = regexp.MustCompile(`\s+`)
+
+// htmlText returns the title and the visible text of an HTML page, with a
+// line break per block
+func htmlText(source string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(source))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	// lineStart is true when the next inline text begins a line
+	lineStart := true
+	write := func(text string) {
+		if text == "" {
+			return
+		}
+		b.WriteString(text)
+		lineStart = strings.HasSuffix(text, "\n")
+	}
+	if title := findHTMLElement(doc, "title"); title != nil && title.FirstChild != nil {
+		write(strings.TrimSpace(title.FirstChild.Data) + "\n\n")
+	}
+
+	var walk func(n *html.Node, pre bool)
+	walk = func(n *html.Node, pre bool) {
+		switch n.Type {
+		case html.TextNode:
+			if pre {
+				write(n.Data)
+				return
+			}
+			text := htmlSpace.ReplaceAllString(n.Data, " ")
+			if lineStart {
+				text = strings.TrimLeft(text, " ")
+			}
+			write(text)
+			return
+		case html.ElementNode:
+			if htmlSkipped[n.Data] {
+				return
+			}
+			if htmlBlocks[n.Data] && !lineStart {
+				write("\n")
+			}
+			switch n.Data {
+			case "li":
+				write("- ")
+			case "td", "th":
+				write("\t")
+			case "pre":
+				pre = true
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, pre)
+		}
+		if n.Type == html.ElementNode && htmlBlocks[n.Data] && !lineStart {
+			write("\n")
+		}
+	}
+	walk(doc, false)
+	return b.String(), nil
+}
+
+func findHTMLElement(n *html.Node, name string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == name {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findHTMLElement(c, name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// xmlTextElements say how the elements of a document XML turn into text
+type xmlTextElements struct {
+	// text holds the elements whose character data is text
+	text map[string]bool
+	// paragraphs end with a line break
+	paragraphs map[string]bool
+	// breaks maps empty elements to the text they stand for
+	breaks map[string]string
+	// skipped elements hold no text of the document
+	skipped map[string]bool
+	// spaces is the element for a run of spaces, counted by its attribute c
+	spaces string
+}
+
+var docxElements = xmlTextElements{
+	text:       map[string]bool{"t": true},
+	paragraphs: map[string]bool{"p": true},
+	breaks:     map[string]string{"br": "\n", "cr": "\n", "tab": "\t"},
+	// tabs holds tab stops, not tabs, and instrText field codes
+	skipped: map[string]bool{"tabs": true, "instrText": true, "delText": true},
+}
+
+var odtElements = xmlTextElements{
+	text:       map[string]bool{"p": true, "h": true},
+	paragraphs: map[string]bool{"p": true, "h": true},
+	breaks:     map[string]string{"line-break": "\n", "tab": "\t"},
+	skipped:    map[string]bool{"annotation": true, "tracked-changes": true},
+	spaces:     "s",
+}
+
+// zipXMLText returns the text of the XML file name inside a DOCX or ODT
+func zipXMLText(data []byte, name string, elements xmlTextElements) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	f, err := archive.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	decoder := xml.NewDecoder(io.LimitReader(f, maxDocumentXML))
+	var b strings.Builder
+	// depth counts the open text elements, skipped the open skipped elements
+	depth, skipped := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := t.Name.Local
+			switch {
+			case elements.skipped[name]:
+				skipped++
+			case skipped > 0:
+			case elements.text[name]:
+				depth++
+			case name == elements.spaces:
+				count := 1
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "c" {
+						fmt.Sscan(attr.Value, &count)
+					}
+				}
+				b.WriteString(strings.Repeat(" ", min(max(count, 1), 100)))
+			case elements.breaks[name] != "":
+				b.WriteString(elements.breaks[name])
+			}
+		case xml.EndElement:
+			name := t.Name.Local
+			switch {
+			case elements.skipped[name]:
+				skipped--
+			case skipped > 0:
+			default:
+				if elements.text[name] {
+					depth--
+				}
+				if elements.paragraphs[name] {
+					b.WriteString("\n")
+				}
+			}
+		case xml.CharData:
+			if depth > 0 && skipped == 0 {
+				b.Write(t)
+			}
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// zipDocument returns an archive holding the given files
+func zipDocument(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+const docxXML = `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:pPr><w:tabs><w:tab w:val="left" w:pos="720"/></w:tabs></w:pPr><w:r><w:t>Once upon</w:t></w:r><w:r><w:t xml:space="preserve"> a time</w:t></w:r></w:p>
+<w:p><w:r><w:t>one</w:t><w:tab/><w:t>two</w:t><w:br/><w:t>three</w:t></w:r></w:p>
+<w:p><w:r><w:instrText>PAGE</w:instrText><w:delText>removed</w:delText></w:r></w:p>
+</w:body></w:document>`
+
+const odtXML = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0"><office:body><office:text>
+<text:h>Title</text:h>
+<text:p>a<text:s text:c="3"/>b<text:line-break/>c<text:tab/>d</text:p>
+<text:p>kept<office:annotation><text:p>note</text:p></office:annotation></text:p>
+</office:text></office:body></office:document-content>`
+
+func TestExtractDocumentText(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "plain text is normalized",
+			data:     []byte("\xEF\xBB\xBFline one  \r\nline two\r\n\r\n\r\n\r\nend\x00"),
+			mimeType: MimeTypeText,
+			want:     "line one\nline two\n\nend",
+		},
+		{
+			name:     "utf-16 little endian",
+			data:     []byte{0xFF, 0xFE, 'h', 0, 'i', 0},
+			mimeType: MimeTypeMarkdown,
+			want:     "hi",
+		},
+		{
+			name:     "utf-16 big endian",
+			data:     []byte{0xFE, 0xFF, 0, 'h', 0, 'i'},
+			mimeType: MimeTypeText,
+			want:     "hi",
+		},
+		{
+			name:     "invalid utf-8 is dropped",
+			data:     []byte("caf\xFFe"),
+			mimeType: MimeTypeText,
+			want:     "cafe",
+		},
+		{
+			name:     "html",
+			data:     []byte("<html><head><title>Trip</title></head><body><p>Day one</p></body></html>"),
+			mimeType: MimeTypeHTML,
+			want:     "Trip\n\nDay one",
+		},
+		{
+			name:     "docx",
+			data:     zipDocument(t, map[string]string{"word/document.xml": docxXML}),
+			mimeType: MimeTypeDOCX,
+			want:     "Once upon a time\none\ttwo\nthree",
+		},
+		{
+			name:     "odt",
+			data:     zipDocument(t, map[string]string{"content.xml": odtXML}),
+			mimeType: MimeTypeODT,
+			want:     "Title\na   b\nc\td\nkept",
+		},
+		{
+			name:     "empty document",
+			data:     []byte(" \n\t\n"),
+			mimeType: MimeTypeText,
+			wantErr:  ErrUnreadableDocument,
+		},
+		{
+			name:     "docx without its document",
+			data:     zipDocument(t, map[string]string{"other.xml": "<a/>"}),
+			mimeType: MimeTypeDOCX,
+			wantErr:  ErrUnreadableDocument,
+		},
+		{
+			name:     "not an archive",
+			data:     []byte("plain"),
+			mimeType: MimeTypeODT,
+			wantErr:  ErrUnreadableDocument,
+		},
+		{
+			name:     "not a document",
+			data:     []byte("\x89PNG"),
+			mimeType: "image/png",
+			wantErr:  ErrUnsupportedMediaType,
+		},
+		{
+			name:     "file too large",
+			data:     make([]byte, maxDocumentSize+1),
+			mimeType: MimeTypeText,
+			wantErr:  ErrDocumentTooLarge,
+		},
+		{
+			name:     "text too long",
+			data:     []byte(strings.Repeat("a", maxDocumentText+1)),
+			mimeType: MimeTypeText,
+			wantErr:  ErrDocumentTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExtractDocumentText(tt.data, tt.mimeType)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTMLText(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			name:   "title comes first",
+			source: "<html><head><title> Title </title></head><body><p>text</p></body></html>",
+			want:   "Title\n\ntext\n",
+		},
+		{
+			name:   "blocks break lines, inline text does not",
+			source: "<div>one <b>bold</b> two</div><p>three</p>",
+			want:   "one bold two\nthree\n",
+		},
+		{
+			name:   "whitespace collapses",
+			source: "<p>  a \n\n   b  </p>",
+			want:   "a b \n",
+		},
+		{
+			name:   "list items and cells",
+			source: "<ul><li>x</li><li>y</li></ul><table><tr><td>1</td><td>2</td></tr></table>",
+			want:   "- x\n- y\n\t1\t2\n",
+		},
+		{
+			name:   "preformatted text keeps its spacing",
+			source: "<pre>a  b\n  c</pre>",
+			want:   "a  b\n  c\n",
+		},
+		{
+			name:   "scripts and styles are skipped",
+			source: "<style>p{}</style><script>alert(1)</script><p>seen</p><noscript>hidden</noscript>",
+			want:   "seen\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := htmlText(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("htmlText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZipXMLText(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		file     string
+		elements xmlTextElements
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "docx paragraphs, tabs and breaks",
+			files:    map[string]string{"word/document.xml": docxXML},
+			file:     "word/document.xml",
+			elements: docxElements,
+			want:     "Once upon a time\none\ttwo\nthree\n\n",
+		},
+		{
+			name:     "odt spaces and skipped annotations",
+			files:    map[string]string{"content.xml": odtXML},
+			file:     "content.xml",
+			elements: odtElements,
+			want:     "Title\na   b\nc\td\nkept\n",
+		},
+		{
+			name:     "space count is bounded",
+			files:    map[string]string{"content.xml": `<p>a<s c="1000"/>b</p>`},
+			file:     "content.xml",
+			elements: odtElements,
+			want:     "a" + strings.Repeat(" ", 100) + "b\n",
+		},
+		{
+			name:     "missing file",
+			files:    map[string]string{"content.xml": "<p/>"},
+			file:     "word/document.xml",
+			elements: docxElements,
+			wantErr:  true,
+		},
+		{
+			name:     "malformed xml",
+			files:    map[string]string{"content.xml": "<p>open"},
+			file:     "content.xml",
+			elements: odtElements,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := zipXMLText(zipDocument(t, tt.files), tt.file, tt.elements)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("zipXMLText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
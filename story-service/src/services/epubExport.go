@@ -0,0 +1,161 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+)
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubCSS = `body { font-family: serif; line-height: 1.5; }
+h1 { text-align: center; }
+figure { margin: 1em 0; text-align: center; }
+figure img { max-width: 100%; }
+figcaption { font-size: 0.85em; }
+.turn.user { font-style: italic; }
+.cover { text-align: center; }
+.cover img { max-width: 100%; max-height: 100%; }
+`
+
+type epubFile struct {
+	name string
+	data []byte
+}
+
+// epubPage wraps a body in an XHTML page of the book
+func epubPage(title, body string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<meta charset="utf-8" />
+<title>` + html.EscapeString(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css" />
+</head>
+<body>
+` + body + `</body>
+</html>
+`
+}
+
+// renderEPUB writes an EPUB 3 book with the cover on its own page and the
+// story in one chapter
+func renderEPUB(doc *exportDocument) ([]byte, error) {
+	// Photos are files of the book, numbered in order
+	images := []*exportImage{}
+	names := map[*exportImage]string{}
+	addImage := func(img *exportImage) {
+		ext := "jpg"
+		if img.mimeType == "image/png" {
+			ext = "png"
+		}
+		names[img] = fmt.Sprintf("images/image-%d.%s", len(images)+1, ext)
+		images = append(images, img)
+	}
+	if doc.cover != nil {
+		addImage(doc.cover)
+	}
+	for _, block := range doc.blocks {
+		if block.image != nil {
+			addImage(block.image)
+		}
+	}
+
+	body, err := doc.bodyHTML(true, func(img *exportImage) string { return names[img] })
+	if err != nil {
+		return nil, err
+	}
+	title := html.EscapeString(doc.title)
+
+	var manifest, spine strings.Builder
+	for i, img := range images {
+		properties := ""
+		if img == doc.cover {
+			properties = ` properties="cover-image"`
+		}
+		fmt.Fprintf(&manifest, "    <item id=\"image-%d\" href=\"%s\" media-type=\"%s\"%s/>\n", i+1, names[img], img.mimeType, properties)
+	}
+	if doc.cover != nil {
+		manifest.WriteString("    <item id=\"cover\" href=\"cover.xhtml\" media-type=\"application/xhtml+xml\"/>\n")
+		spine.WriteString("    <itemref idref=\"cover\"/>\n")
+	}
+	spine.WriteString("    <itemref idref=\"story\"/>\n")
+
+	opf := `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="book-id">urn:story-session:` + html.EscapeString(doc.sessionID) + `</dc:identifier>
+    <dc:title>` + title + `</dc:title>
+    <dc:language>und</dc:language>
+    <meta property="dcterms:modified">` + doc.updatedAt.UTC().Format("2006-01-02T15:04:05Z") + `</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+    <item id="story" href="story.xhtml" media-type="application/xhtml+xml"/>
+` + manifest.String() + `  </manifest>
+  <spine>
+` + spine.String() + `  </spine>
+</package>
+`
+	nav := epubPage(doc.title, `<nav epub:type="toc" id="toc">
+<h1>Contents</h1>
+<ol><li><a href="story.xhtml">`+title+`</a></li></ol>
+</nav>
+`)
+
+	files := []epubFile{
+		{"META-INF/container.xml", []byte(epubContainer)},
+		{"OEBPS/content.opf", []byte(opf)},
+		{"OEBPS/nav.xhtml", []byte(nav)},
+		{"OEBPS/style.css", []byte(epubCSS)},
+		{"OEBPS/story.xhtml", []byte(epubPage(doc.title, "<h1>"+title+"</h1>\n"+body))},
+	}
+	if doc.cover != nil {
+		cover := fmt.Sprintf("<div class=\"cover\"><img src=\"%s\" alt=\"%s\" /></div>\n", names[doc.cover], title)
+		files = append(files, epubFile{"OEBPS/cover.xhtml", []byte(epubPage(doc.title, cover))})
+	}
+
+	var out bytes.Buffer
+	archive := zip.NewWriter(&out)
+	// The mimetype file comes first and uncompressed so readers can sniff it
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte("application/epub+zip")); err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if err := writeZipFile(archive, f.name, f.data); err != nil {
+			return nil, err
+		}
+	}
+	for _, img := range images {
+		if err := writeZipFile(archive, "OEBPS/"+names[img], img.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func writeZipFile(archive *zip.Writer, name string, data []byte) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
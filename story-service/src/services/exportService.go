@@ -0,0 +1,304 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+)
+
+const (
+	ExportMarkdown = "md"
+	ExportHTML     = "html"
+	ExportPDF      = "pdf"
+	ExportEPUB     = "epub"
+
+	defaultExportTitle = "Story"
+)
+
+var ErrInvalidExportFormat = errors.New("invalid export format")
+
+// ExportOptions choose the format of an export and whether it keeps the
+// user's turns or only the story the model wrote
+type ExportOptions struct {
+	Format    string
+	ModelOnly bool
+}
+
+// Export is a session rendered into a file
+type Export struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// exportDocument is a session ready to be rendered: its source image as the
+// cover, then the turns of the active branch with the later photos in
+// between
+type exportDocument struct {
+	title     string
+	sessionID string
+	updatedAt time.Time
+	cover     *exportImage
+	blocks    []exportBlock
+}
+
+// exportBlock is a turn of the conversation or a photo
+type exportBlock struct {
+	sender string
+	text   string
+	image  *exportImage
+}
+
+type exportImage struct {
+	name     string
+	mimeType string
+	data     []byte
+}
+
+// dataURI embeds the image in a standalone document
+func (img *exportImage) dataURI() string {
+	return "data:" + img.mimeType + ";base64," + base64.StdEncoding.EncodeToString(img.data)
+}
+
+// ExportSession renders the active branch of a session into a Markdown,
+// HTML, PDF or EPUB file
+func ExportSession(ctx context.Context, userID, sessionID string, opts ExportOptions) (*Export, error) {
+	var render func(*exportDocument) ([]byte, error)
+	contentType := ""
+	switch opts.Format {
+	case ExportMarkdown:
+		render, contentType = renderMarkdown, "text/markdown; charset=utf-8"
+	case ExportHTML:
+		render, contentType = renderHTML, "text/html; charset=utf-8"
+	case ExportPDF:
+		render, contentType = renderPDF, "application/pdf"
+	case ExportEPUB:
+		render, contentType = renderEPUB, "application/epub+zip"
+	default:
+		return nil, fmt.Errorf("%w: %q, expected md, html, pdf or epub", ErrInvalidExportFormat, opts.Format)
+	}
+
+	doc, err := loadExportDocument(ctx, userID, sessionID, opts.ModelOnly)
+	if err != nil {
+		return nil, err
+	}
+	data, err := render(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &Export{
+		Filename:    exportFilename(doc.title) + "." + opts.Format,
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
+
+func loadExportDocument(ctx context.Context, userID, sessionID string, modelOnly bool) (*exportDocument, error) {
+	session, err := GetSession(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	attachments, err := listAttachments(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := loadStoredMessages(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &exportDocument{title: strings.TrimSpace(session.Title), sessionID: session.ID, updatedAt: session.UpdatedAt}
+	if doc.title == "" {
+		doc.title = defaultExportTitle
+	}
+
+	// The source image of the session, or else its first photo, is the cover
+	coverID := int64(0)
+	for _, a := range attachments {
+		if isExportImage(a.ContentType) && (coverID == 0 || session.FileID != nil && *session.FileID == a.ID) {
+			coverID = a.ID
+		}
+	}
+
+	// Other photos are placed where they were sent, like in the model history
+	next := 0
+	photosUntil := func(messageID int64) error {
+		for ; next < len(attachments) && attachments[next].afterMessageID < messageID; next++ {
+			a := attachments[next]
+			if !isExportImage(a.ContentType) {
+				continue
+			}
+			data, err := loadFileData(ctx, userID, a.ID)
+			if err != nil {
+				return err
+			}
+			img := &exportImage{name: a.Filename, mimeType: a.ContentType, data: data}
+			if a.ID == coverID {
+				doc.cover = img
+				continue
+			}
+			doc.blocks = append(doc.blocks, exportBlock{image: img})
+		}
+		return nil
+	}
+	for _, message := range messages {
+		if err := photosUntil(message.id); err != nil {
+			return nil, err
+		}
+		if modelOnly && message.Sender != "model" {
+			continue
+		}
+		doc.blocks = append(doc.blocks, exportBlock{sender: message.Sender, text: message.Content})
+	}
+	if err := photosUntil(math.MaxInt64); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// isExportImage reports whether the file is a photo all formats can show
+func isExportImage(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/png"
+}
+
+var unsafeFilename = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+// exportFilename turns the title into a file name without an extension
+func exportFilename(title string) string {
+	name := strings.Trim(unsafeFilename.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if len([]rune(name)) > 80 {
+		name = strings.TrimRight(string([]rune(name)[:80]), "-")
+	}
+	if name == "" {
+		return strings.ToLower(defaultExportTitle)
+	}
+	return name
+}
+
+// turnHeading names the speaker of a turn when the user's turns are kept
+func turnHeading(sender string) string {
+	if sender == "user" {
+		return "You"
+	}
+	return "Story"
+}
+
+// hasUserTurns reports whether the document keeps the user's turns, which
+// are then told apart from the model's with headings
+func (doc *exportDocument) hasUserTurns() bool {
+	for _, block := range doc.blocks {
+		if block.sender == "user" {
+			return true
+		}
+	}
+	return false
+}
+
+func renderMarkdown(doc *exportDocument) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", doc.title)
+	if doc.cover != nil {
+		fmt.Fprintf(&b, "![%s](%s)\n\n", markdownAlt(doc.cover.name), doc.cover.dataURI())
+	}
+	headings := doc.hasUserTurns()
+	for _, block := range doc.blocks {
+		switch {
+		case block.image != nil:
+			fmt.Fprintf(&b, "![%s](%s)\n\n", markdownAlt(block.image.name), block.image.dataURI())
+		case headings:
+			fmt.Fprintf(&b, "## %s\n\n%s\n\n", turnHeading(block.sender), strings.TrimSpace(block.text))
+		default:
+			fmt.Fprintf(&b, "%s\n\n", strings.TrimSpace(block.text))
+		}
+	}
+	return []byte(strings.TrimRight(b.String(), "\n") + "\n"), nil
+}
+
+func markdownAlt(name string) string {
+	return strings.NewReplacer("[", "(", "]", ")").Replace(name)
+}
+
+// storyMarkdown renders the Markdown of the model's turns. Raw HTML in them
+// is left out. xhtml closes empty elements for EPUB.
+func storyMarkdown(text string, xhtml bool) (string, error) {
+	options := []goldmark.Option{}
+	if xhtml {
+		options = append(options, goldmark.WithRendererOptions(gmhtml.WithXHTML()))
+	}
+	var out bytes.Buffer
+	if err := goldmark.New(options...).Convert([]byte(text), &out); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// bodyHTML renders the turns and the photos of the document. imageSrc
+// returns the source of an image in the output.
+func (doc *exportDocument) bodyHTML(xhtml bool, imageSrc func(*exportImage) string) (string, error) {
+	var b strings.Builder
+	headings := doc.hasUserTurns()
+	for _, block := range doc.blocks {
+		if block.image != nil {
+			b.WriteString(figureHTML(block.image, imageSrc(block.image), xhtml))
+			continue
+		}
+		fmt.Fprintf(&b, "<section class=\"turn %s\">\n", block.sender)
+		if headings {
+			fmt.Fprintf(&b, "<h2>%s</h2>\n", turnHeading(block.sender))
+		}
+		body, err := storyMarkdown(block.text, xhtml)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(body)
+		b.WriteString("</section>\n")
+	}
+	return b.String(), nil
+}
+
+func figureHTML(img *exportImage, src string, xhtml bool) string {
+	end := ">"
+	if xhtml {
+		end = " />"
+	}
+	name := html.EscapeString(img.name)
+	return fmt.Sprintf("<figure><img src=\"%s\" alt=\"%s\"%s<figcaption>%s</figcaption></figure>\n",
+		html.EscapeString(src), name, end, name)
+}
+
+const exportCSS = `body { font-family: Georgia, serif; line-height: 1.6; max-width: 42em; margin: 2em auto; padding: 0 1em; color: #222; }
+h1 { text-align: center; }
+figure { margin: 1.5em 0; text-align: center; }
+figure img { max-width: 100%; height: auto; }
+figcaption { font-size: 0.85em; color: #666; }
+.turn.user { border-left: 3px solid #ccc; padding-left: 1em; color: #555; }
+.cover { page-break-after: always; }
+@media print { body { margin: 0; max-width: none; } section, figure { page-break-inside: avoid; } }
+`
+
+func renderHTML(doc *exportDocument) ([]byte, error) {
+	body, err := doc.bodyHTML(false, (*exportImage).dataURI)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	fmt.Fprintf(&b, "<title>%s</title>\n<style>\n%s</style>\n</head>\n<body>\n", html.EscapeString(doc.title), exportCSS)
+	fmt.Fprintf(&b, "<h1>%s</h1>\n", html.EscapeString(doc.title))
+	if doc.cover != nil {
+		fmt.Fprintf(&b, "<div class=\"cover\">%s</div>\n", figureHTML(doc.cover, doc.cover.dataURI(), false))
+	}
+	b.WriteString(body)
+	b.WriteString("</body>\n</html>\n")
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExportFilename(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{title: "A Day at the Beach", want: "a-day-at-the-beach"},
+		{title: "  Trip: Paris / Rome!  ", want: "trip-paris-rome"},
+		{title: "Été à Zürich", want: "été-à-zürich"},
+		{title: "東京の夜", want: "東京の夜"},
+		{title: "../../etc/passwd", want: "etc-passwd"},
+		{title: "!!!", want: "story"},
+		{title: "", want: "story"},
+		{title: strings.Repeat("ab ", 40), want: strings.TrimSuffix(strings.Repeat("ab-", 27), "-")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			got := exportFilename(tt.title)
+			if got != tt.want {
+				t.Errorf("exportFilename(%q) = %q, want %q", tt.title, got, tt.want)
+			}
+			if len([]rune(got)) > 80 {
+				t.Errorf("exportFilename(%q) has %d characters, want at most 80", tt.title, len([]rune(got)))
+			}
+		})
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	photo := &exportImage{name: "beach [1].png", mimeType: "image/png", data: []byte("png")}
+	photoURI := "data:image/png;base64,cG5n"
+
+	tests := []struct {
+		name string
+		doc  *exportDocument
+		want string
+	}{
+		{
+			name: "story only",
+			doc: &exportDocument{title: "Beach", blocks: []exportBlock{
+				{sender: "model", text: "Once upon a time.\n"},
+				{sender: "model", text: "The end."},
+			}},
+			want: "# Beach\n\nOnce upon a time.\n\nThe end.\n",
+		},
+		{
+			name: "turns get headings with user turns",
+			doc: &exportDocument{title: "Beach", blocks: []exportBlock{
+				{sender: "model", text: "Once upon a time."},
+				{sender: "user", text: "  Make it longer  "},
+				{sender: "model", text: "Once upon a long time."},
+			}},
+			want: "# Beach\n\n## Story\n\nOnce upon a time.\n\n## You\n\nMake it longer\n\n## Story\n\nOnce upon a long time.\n",
+		},
+		{
+			name: "cover and photos are embedded",
+			doc: &exportDocument{title: "Album", cover: photo, blocks: []exportBlock{
+				{image: photo},
+				{sender: "model", text: "A day out."},
+			}},
+			want: "# Album\n\n![beach (1).png](" + photoURI + ")\n\n![beach (1).png](" + photoURI + ")\n\nA day out.\n",
+		},
+		{
+			name: "no turns",
+			doc:  &exportDocument{title: "Empty"},
+			want: "# Empty\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderMarkdown(tt.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("renderMarkdown() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
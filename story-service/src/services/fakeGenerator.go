@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+const (
+	fakeModelName = "fake-story-model"
+	// fakeContextWindow is small so history summarization can be exercised offline
+	fakeContextWindow = 8192
+)
+
+// fakeGenerator is an in-process generator that returns deterministic replies
+// derived from its input. It needs no credentials or network access.
+type fakeGenerator struct{}
+
+func newFakeGenerator() *fakeGenerator {
+	return &fakeGenerator{}
+}
+
+func (g *fakeGenerator) Name() string {
+	return fakeModelName
+}
+
+func (g *fakeGenerator) GenerateContent(
+	ctx context.Context,
+	config genai.GenerationConfig,
+	parts ...genai.Part,
+) (*genai.GenerateContentResponse, error) {
+	return g.generate(ctx, []*genai.Content{{Role: "user", Parts: parts}})
+}
+
+func (g *fakeGenerator) ContextWindow() int {
+	return fakeContextWindow
+}
+
+func (g *fakeGenerator) SupportsMediaType(mimeType string) bool {
+	return true
+}
+
+func (g *fakeGenerator) CountTokens(ctx context.Context, contents []*genai.Content) (int, error) {
+	return 0, errCountTokensUnsupported
+}
+
+func (g *fakeGenerator) StartChat(history []*genai.Content) ChatSession {
+	return &contentChat{history: history, generate: g.generate, stream: g.stream}
+}
+
+// stream splits the generated reply into one chunk per word.
+func (g *fakeGenerator) stream(ctx context.Context, contents []*genai.Content) ResponseIterator {
+	resp, err := g.generate(ctx, contents)
+	if err != nil {
+		return &sliceIterator{err: err}
+	}
+
+	text := string(resp.Candidates[0].Content.Parts[0].(genai.Text))
+	words := strings.SplitAfter(text, " ")
+	chunks := make([]*genai.GenerateContentResponse, 0, len(words))
+	for i, word := range words {
+		chunk := &genai.GenerateContentResponse{
+			Candidates: []*genai.Candidate{
+				{Content: &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(word)}}},
+			},
+		}
+		if i == len(words)-1 {
+			chunk.Candidates[0].FinishReason = genai.FinishReasonStop
+			chunk.UsageMetadata = resp.UsageMetadata
+		}
+		chunks = append(chunks, chunk)
+	}
+	return &sliceIterator{responses: chunks}
+}
+
+func (g *fakeGenerator) generate(ctx context.Context, contents []*genai.Content) (*genai.GenerateContentResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var last *genai.Content
+	if len(contents) > 0 {
+		last = contents[len(contents)-1]
+	}
+
+	descriptions := []string{}
+	if last != nil {
+		for _, part := range last.Parts {
+			descriptions = append(descriptions, describeFakePart(part))
+		}
+	}
+	text := fmt.Sprintf("[%s] turn %d: %s", fakeModelName, len(contents), strings.Join(descriptions, "; "))
+
+	promptTokens := int32(0)
+	for _, content := range contents {
+		for _, part := range content.Parts {
+			promptTokens += int32(len(describeFakePart(part)) / 4)
+		}
+	}
+	candidateTokens := int32(len(text) / 4)
+
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{
+			{
+				Content:      &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(text)}},
+				FinishReason: genai.FinishReasonStop,
+			},
+		},
+		UsageMetadata: &genai.UsageMetadata{
+			PromptTokenCount:     promptTokens,
+			CandidatesTokenCount: candidateTokens,
+			TotalTokenCount:      promptTokens + candidateTokens,
+		},
+	}, nil
+}
+
+func describeFakePart(part genai.Part) string {
+	switch p := part.(type) {
+	case genai.Text:
+		return fmt.Sprintf("you said %q", string(p))
+	case genai.Blob:
+		return fmt.Sprintf("a story about a %s file of %d bytes", p.MIMEType, len(p.Data))
+	default:
+		return fmt.Sprintf("an unsupported %T part", part)
+	}
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	ProviderVertex = "vertex"
+	ProviderOpenAI = "openai"
+	ProviderFake   = "fake"
+)
+
+// StoryGenerator is a text-generation backend. Requests and responses use the
+// genai types so callers do not depend on the concrete provider.
+type StoryGenerator interface {
+	// Name returns the model name used for generation.
+	Name() string
+	// GenerateContent produces a single response for the given parts.
+	GenerateContent(ctx context.Context, config genai.GenerationConfig, parts ...genai.Part) (*genai.GenerateContentResponse, error)
+	// StartChat starts a chat session seeded with history.
+	StartChat(history []*genai.Content) ChatSession
+	// ContextWindow returns the number of input tokens the model accepts.
+	ContextWindow() int
+	// CountTokens counts the tokens of contents with the model. It returns
+	// errCountTokensUnsupported if the backend cannot count them.
+	CountTokens(ctx context.Context, contents []*genai.Content) (int, error)
+	// SupportsMediaType reports whether the model reads files of the MIME
+	// type sent as they are, written documents are sent as text.
+	SupportsMediaType(mimeType string) bool
+}
+
+// ChatSession is a multi-turn conversation with a StoryGenerator.
+type ChatSession interface {
+	// SendMessage sends the parts as a user turn and appends the reply to the history.
+	SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error)
+	// SendMessageStream is like SendMessage but returns the reply in chunks.
+	// The reply is appended to the history once the iterator is exhausted.
+	SendMessageStream(ctx context.Context, parts ...genai.Part) ResponseIterator
+	// History returns the turns of the conversation so far.
+	History() []*genai.Content
+	// SetHistory replaces the turns of the conversation, e.g. to drop a
+	// user turn whose reply failed.
+	SetHistory(history []*genai.Content)
+}
+
+// ResponseIterator enumerates the chunks of a streamed reply.
+// Next returns iterator.Done when the reply is complete. Close releases the
+// stream and must be called also when the reply is not read to the end.
+type ResponseIterator interface {
+	Next() (*genai.GenerateContentResponse, error)
+	Close() error
+}
+
+var Generator StoryGenerator
+
+// CreateStoryGenerator creates the generator selected by GENAI_PROVIDER.
+// It defaults to Vertex AI.
+func CreateStoryGenerator() error {
+	provider := os.Getenv("GENAI_PROVIDER")
+	if provider == "" {
+		provider = ProviderVertex
+	}
+
+	var err error
+	switch provider {
+	case ProviderVertex:
+		Generator, err = newVertexGenerator(context.Background())
+	case ProviderOpenAI:
+		Generator, err = newOpenAIGenerator()
+	case ProviderFake:
+		Generator = newFakeGenerator()
+	default:
+		return fmt.Errorf("unknown GENAI_PROVIDER %q", provider)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("using %s generator with model %s", provider, Generator.Name())
+	return nil
+}
+
+// generateFunc produces a model response for a whole conversation.
+type generateFunc func(ctx context.Context, contents []*genai.Content) (*genai.GenerateContentResponse, error)
+
+// streamFunc is like generateFunc but streams the response.
+type streamFunc func(ctx context.Context, contents []*genai.Content) ResponseIterator
+
+// contentChat is a ChatSession for backends that are stateless and receive the
+// full conversation on every request.
+type contentChat struct {
+	history  []*genai.Content
+	generate generateFunc
+	stream   streamFunc
+}
+
+func (cs *contentChat) SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	cs.history = append(cs.history, &genai.Content{Role: "user", Parts: parts})
+	resp, err := cs.generate(ctx, cs.history)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil {
+		reply := resp.Candidates[0].Content
+		reply.Role = "model"
+		cs.history = append(cs.history, reply)
+	}
+	return resp, nil
+}
+
+func (cs *contentChat) History() []*genai.Content {
+	return cs.history
+}
+
+func (cs *contentChat) SetHistory(history []*genai.Content) {
+	cs.history = history
+}
+
+func (cs *contentChat) SendMessageStream(ctx context.Context, parts ...genai.Part) ResponseIterator {
+	cs.history = append(cs.history, &genai.Content{Role: "user", Parts: parts})
+	return &historyIterator{cs: cs, iter: cs.stream(ctx, cs.history)}
+}
+
+// historyIterator collects the streamed reply and adds it to the chat history
+// when the stream ends.
+type historyIterator struct {
+	cs    *contentChat
+	iter  ResponseIterator
+	reply []genai.Part
+}
+
+func (it *historyIterator) Next() (*genai.GenerateContentResponse, error) {
+	resp, err := it.iter.Next()
+	if err == iterator.Done {
+		if len(it.reply) > 0 {
+			it.cs.history = append(it.cs.history, &genai.Content{Role: "model", Parts: it.reply})
+			it.reply = nil
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil {
+		it.reply = append(it.reply, resp.Candidates[0].Content.Parts...)
+	}
+	return resp, nil
+}
+
+func (it *historyIterator) Close() error {
+	return it.iter.Close()
+}
+
+// sliceIterator replays responses that are already in memory.
+type sliceIterator struct {
+	responses []*genai.GenerateContentResponse
+	err       error
+}
+
+func (it *sliceIterator) Next() (*genai.GenerateContentResponse, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if len(it.responses) == 0 {
+		return nil, iterator.Done
+	}
+	resp := it.responses[0]
+	it.responses = it.responses[1:]
+	return resp, nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// CheckGeneratorMediaType returns ErrUnsupportedMediaType when the model of
+// the configured provider cannot read files of the MIME type
+func CheckGeneratorMediaType(mimeType string) error {
+	if isTextDocument(mimeType) || Generator == nil || Generator.SupportsMediaType(mimeType) {
+		return nil
+	}
+	return fmt.Errorf("%w: the %s model cannot read %s files", ErrUnsupportedMediaType, Generator.Name(), mimeType)
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+const (
+	// historyBudgetRatio is the share of the context window the history may
+	// use, the rest is left for the reply
+	historyBudgetRatio = 0.8
+	// recentTurnsRatio is the share of the history budget kept verbatim when
+	// older turns are summarized
+	recentTurnsRatio = 0.5
+
+	summaryPrefix = "Summary of the earlier conversation about these files:\n"
+	summaryPrompt = "Summarize the conversation below so it can replace the original turns in a chat about a story. " +
+		"Keep names, places, plot events, the story's style and every request the user made. " +
+		"Write plain prose without a title."
+)
+
+var errCountTokensUnsupported = errors.New("token counting is not supported")
+
+// sessionSummary replaces the messages up to coveredID in the model history
+type sessionSummary struct {
+	text      string
+	coveredID int64
+}
+
+// buildChatHistory assembles the history sent to the model. When it does not
+// fit in the context window, the oldest turns are folded into the session's
+// rolling summary, which is saved so it is not recomputed on every connect.
+// A summary of another branch is not used.
+func buildChatHistory(
+	ctx context.Context,
+	userID, sessionID string,
+	attachments []*sessionAttachment,
+	messages []storedMessage,
+) ([]*genai.Content, error) {
+	summary, err := loadSessionSummary(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !summaryOnBranch(summary, messages) {
+		summary = sessionSummary{}
+	}
+	turns := []storedMessage{}
+	for _, message := range messages {
+		if message.id > summary.coveredID {
+			turns = append(turns, message)
+		}
+	}
+
+	contents := assembleHistory(attachments, summary, turns)
+	budget := historyBudget()
+	if countTokens(ctx, contents) <= budget {
+		return contents, nil
+	}
+
+	// Keep the most recent turns that fit in their share of the budget. The
+	// kept turns follow a user turn, so they must start with a model turn.
+	keepBudget := int(float64(budget) * recentTurnsRatio)
+	keepFrom, used := len(turns), 0
+	for i := len(turns) - 1; i >= 0; i-- {
+		used += EstimateTokens([]*genai.Content{storedMessageContent(turns[i])})
+		if used > keepBudget {
+			break
+		}
+		keepFrom = i
+	}
+	for keepFrom < len(turns) && turns[keepFrom].Sender != "model" {
+		keepFrom++
+	}
+	if keepFrom == 0 {
+		log.Printf("history of session %s is over budget but has no turns to summarize", sessionID)
+		return contents, nil
+	}
+
+	dropped := turns[:keepFrom]
+	text, err := summarizeTurns(ctx, userID, sessionID, summary.text, dropped)
+	if err != nil {
+		return nil, fmt.Errorf("could not summarize history: %w", err)
+	}
+	summary = sessionSummary{text: text, coveredID: dropped[len(dropped)-1].id}
+	if err := saveSessionSummary(userID, sessionID, summary); err != nil {
+		log.Printf("could not save summary of session %s: %v", sessionID, err)
+	}
+	return assembleHistory(attachments, summary, turns[keepFrom:]), nil
+}
+
+// summaryOnBranch reports whether the last message the summary covers is on
+// the branch. Message IDs grow along a branch, so the summary then covers
+// exactly the branch's messages up to it.
+func summaryOnBranch(summary sessionSummary, messages []storedMessage) bool {
+	if summary.coveredID == 0 {
+		return true
+	}
+	for _, message := range messages {
+		if message.id == summary.coveredID {
+			return true
+		}
+	}
+	return false
+}
+
+// HistoryExceedsBudget reports whether a live chat history has outgrown the
+// context window and should be rebuilt with LoadChatHistory. It counts the
+// tokens the way the rebuild does, a history the rebuild would keep as it is
+// never triggers one.
+func HistoryExceedsBudget(ctx context.Context, history []*genai.Content) bool {
+	return countTokens(ctx, history) > historyBudget()
+}
+
+// assembleHistory puts the files sent before the remaining turns and the
+// summary in the first user turn. Later files are placed between the turns
+// in the order they were uploaded.
+func assembleHistory(attachments []*sessionAttachment, summary sessionSummary, turns []storedMessage) []*genai.Content {
+	next := 0
+	// attachmentsUntil returns the parts of the files sent before messageID
+	attachmentsUntil := func(messageID int64) []genai.Part {
+		parts := []genai.Part{}
+		for ; next < len(attachments) && attachments[next].afterMessageID < messageID; next++ {
+			parts = append(parts, attachments[next].parts...)
+		}
+		return parts
+	}
+
+	first := &genai.Content{Role: "user", Parts: attachmentsUntil(summary.coveredID + 1)}
+	if summary.text != "" {
+		first.Parts = append(first.Parts, genai.Text(summaryPrefix+summary.text))
+	}
+
+	contents := []*genai.Content{first}
+	for _, turn := range turns {
+		contents = append(contents, &genai.Content{Role: "user", Parts: attachmentsUntil(turn.id)})
+		contents = append(contents, storedMessageContent(turn))
+	}
+	contents = append(contents, &genai.Content{Role: "user", Parts: attachmentsUntil(math.MaxInt64)})
+	return mergeTurns(contents)
+}
+
+// mergeTurns drops empty turns and joins consecutive turns of the same role,
+// the model expects user and model turns to alternate
+func mergeTurns(contents []*genai.Content) []*genai.Content {
+	merged := []*genai.Content{}
+	for _, content := range contents {
+		if len(content.Parts) == 0 {
+			continue
+		}
+		if n := len(merged); n > 0 && merged[n-1].Role == content.Role {
+			merged[n-1].Parts = append(merged[n-1].Parts, content.Parts...)
+			continue
+		}
+		merged = append(merged, &genai.Content{Role: content.Role, Parts: append([]genai.Part{}, content.Parts...)})
+	}
+	return merged
+}
+
+func storedMessageContent(message storedMessage) *genai.Content {
+	return &genai.Content{Role: message.Sender, Parts: []genai.Part{genai.Text(message.Content)}}
+}
+
+func summarizeTurns(ctx context.Context, userID, sessionID, previous string, turns []storedMessage) (string, error) {
+	var b strings.Builder
+	b.WriteString(summaryPrompt)
+	if previous != "" {
+		b.WriteString("\n\nSummary so far:\n")
+		b.WriteString(previous)
+	}
+	b.WriteString("\n\nConversation:\n")
+	for _, turn := range turns {
+		role := "User"
+		if turn.Sender == "model" {
+			role = "Model"
+		}
+		fmt.Fprintf(&b, "%s: %s\n", role, turn.Content)
+	}
+
+	config := genai.GenerationConfig{}
+	config.SetTemperature(0.2)
+	resp, err := Generator.GenerateContent(ctx, config, genai.Text(b.String()))
+	if err != nil {
+		return "", err
+	}
+	RecordUsage(userID, sessionID, UsageSummary, resp.UsageMetadata)
+	return ParseContentResponse(resp)
+}
+
+// historyBudget is the number of tokens the history may use.
+// GENAI_CONTEXT_WINDOW overrides the generator's context window.
+func historyBudget() int {
+	window := Generator.ContextWindow()
+	if value, err := strconv.Atoi(os.Getenv("GENAI_CONTEXT_WINDOW")); err == nil && value > 0 {
+		window = value
+	}
+	return int(float64(window) * historyBudgetRatio)
+}
+
+// countTokens counts the tokens of contents with the generator, falling back
+// to EstimateTokens when it cannot count them
+func countTokens(ctx context.Context, contents []*genai.Content) int {
+	n, err := Generator.CountTokens(ctx, contents)
+	if err != nil {
+		if err != errCountTokensUnsupported {
+			log.Printf("could not count tokens, using an estimate: %v", err)
+		}
+		return EstimateTokens(contents)
+	}
+	return n
+}
+
+// EstimateTokens roughly estimates the tokens of contents without a model.
+// Text is about four characters per token. Media use the rates of Gemini:
+// 258 tokens per image or PDF page, 263 per second of video and 32 per second
+// of audio, approximated from typical file sizes.
+func EstimateTokens(contents []*genai.Content) int {
+	total := 0
+	for _, content := range contents {
+		for _, part := range content.Parts {
+			switch p := part.(type) {
+			case genai.Text:
+				total += utf8.RuneCountInString(string(p))/4 + 1
+			case genai.Blob:
+				total += estimateBlobTokens(p)
+			}
+		}
+	}
+	return total
+}
+
+func estimateBlobTokens(blob genai.Blob) int {
+	size := len(blob.Data)
+	switch {
+	case strings.HasPrefix(blob.MIMEType, "image/"):
+		return 258
+	case blob.MIMEType == "application/pdf":
+		// about 50KB per page
+		return max(258, size/200)
+	case strings.HasPrefix(blob.MIMEType, "video/"):
+		// about 1MB per second of phone video
+		return max(263, size/4000)
+	case strings.HasPrefix(blob.MIMEType, "audio/"):
+		// about 16KB per second of compressed audio
+		return max(32, size/500)
+	default:
+		return size / 4
+	}
+}
+
+func loadSessionSummary(userID, sessionID string) (sessionSummary, error) {
+	summary := sessionSummary{}
+	stmt := "SELECT summary, covered_message_id FROM session_summaries WHERE user_id = $1 AND session_id = $2"
+	err := models.Db.QueryRow(stmt, userID, sessionID).Scan(&summary.text, &summary.coveredID)
+	if err == sql.ErrNoRows {
+		return sessionSummary{}, nil
+	}
+	return summary, err
+}
+
+func saveSessionSummary(userID, sessionID string, summary sessionSummary) error {
+	stmt := `INSERT INTO session_summaries(user_id, session_id, summary, covered_message_id)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (session_id) DO UPDATE
+	SET summary = EXCLUDED.summary, covered_message_id = EXCLUDED.covered_message_id, updated_at = CURRENT_TIMESTAMP`
+	_, err := models.Db.Exec(stmt, userID, sessionID, summary.text, summary.coveredID)
+	return err
+}
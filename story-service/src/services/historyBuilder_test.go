@@ -0,0 +1,164 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+// contentLines describes each turn as its role and its text parts, so
+// histories compare as plain strings
+func contentLines(contents []*genai.Content) []string {
+	lines := []string{}
+	for _, content := range contents {
+		parts := []string{}
+		for _, part := range content.Parts {
+			switch p := part.(type) {
+			case genai.Text:
+				parts = append(parts, string(p))
+			case genai.Blob:
+				parts = append(parts, "<"+p.MIMEType+">")
+			}
+		}
+		lines = append(lines, content.Role+": "+strings.Join(parts, " | "))
+	}
+	return lines
+}
+
+func turn(id int64, sender, text string) storedMessage {
+	return storedMessage{id: id, Message: models.Message{Sender: sender, Content: text}}
+}
+
+func attachment(afterMessageID int64, label string) *sessionAttachment {
+	return &sessionAttachment{afterMessageID: afterMessageID, parts: []genai.Part{genai.Text(label)}}
+}
+
+func TestMergeTurns(t *testing.T) {
+	user := func(texts ...string) *genai.Content {
+		c := &genai.Content{Role: "user"}
+		for _, text := range texts {
+			c.Parts = append(c.Parts, genai.Text(text))
+		}
+		return c
+	}
+	model := func(text string) *genai.Content {
+		return &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(text)}}
+	}
+
+	tests := []struct {
+		name     string
+		contents []*genai.Content
+		want     []string
+	}{
+		{name: "nothing", contents: nil, want: []string{}},
+		{
+			name:     "alternating turns are kept",
+			contents: []*genai.Content{user("a"), model("b"), user("c")},
+			want:     []string{"user: a", "model: b", "user: c"},
+		},
+		{
+			name:     "empty turns are dropped",
+			contents: []*genai.Content{user(), user("a"), model("b"), user()},
+			want:     []string{"user: a", "model: b"},
+		},
+		{
+			name:     "same roles are joined",
+			contents: []*genai.Content{user("file"), user("a", "b"), model("c"), model("d")},
+			want:     []string{"user: file | a | b", "model: c | d"},
+		},
+		{
+			name:     "empty turn between same roles",
+			contents: []*genai.Content{model("a"), user(), model("b")},
+			want:     []string{"model: a | b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentLines(mergeTurns(tt.contents)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeTurns() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeTurnsKeepsInput(t *testing.T) {
+	first := &genai.Content{Role: "user", Parts: []genai.Part{genai.Text("a")}}
+	second := &genai.Content{Role: "user", Parts: []genai.Part{genai.Text("b")}}
+	mergeTurns([]*genai.Content{first, second})
+	if len(first.Parts) != 1 {
+		t.Errorf("first turn has %d parts after merging, want 1", len(first.Parts))
+	}
+}
+
+func TestAssembleHistory(t *testing.T) {
+	tests := []struct {
+		name        string
+		attachments []*sessionAttachment
+		summary     sessionSummary
+		turns       []storedMessage
+		want        []string
+	}{
+		{
+			name:        "file before the conversation",
+			attachments: []*sessionAttachment{attachment(0, "[file 1]")},
+			turns:       []storedMessage{turn(1, "model", "story"), turn(2, "user", "more"), turn(3, "model", "sequel")},
+			want:        []string{"user: [file 1]", "model: story", "user: more", "model: sequel"},
+		},
+		{
+			name:        "files join the turn they were sent before",
+			attachments: []*sessionAttachment{attachment(0, "[file 1]"), attachment(1, "[file 2]")},
+			turns:       []storedMessage{turn(1, "model", "story"), turn(2, "user", "and this?"), turn(3, "model", "sure")},
+			want:        []string{"user: [file 1]", "model: story", "user: [file 2] | and this?", "model: sure"},
+		},
+		{
+			name:        "file after the last turn",
+			attachments: []*sessionAttachment{attachment(0, "[file 1]"), attachment(1, "[file 2]")},
+			turns:       []storedMessage{turn(1, "model", "story")},
+			want:        []string{"user: [file 1]", "model: story", "user: [file 2]"},
+		},
+		{
+			name:        "summary follows the files it covers",
+			attachments: []*sessionAttachment{attachment(0, "[file 1]"), attachment(2, "[file 2]"), attachment(5, "[file 3]")},
+			summary:     sessionSummary{text: "so far", coveredID: 4},
+			turns:       []storedMessage{turn(5, "user", "go on"), turn(6, "model", "ok")},
+			want:        []string{"user: [file 1] | [file 2] | " + summaryPrefix + "so far | go on | [file 3]", "model: ok"},
+		},
+		{
+			name:  "no files",
+			turns: []storedMessage{turn(1, "user", "hi"), turn(2, "model", "hello")},
+			want:  []string{"user: hi", "model: hello"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentLines(assembleHistory(tt.attachments, tt.summary, tt.turns))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("assembleHistory() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaryOnBranch(t *testing.T) {
+	branch := []storedMessage{turn(1, "model", "a"), turn(4, "user", "b"), turn(5, "model", "c")}
+	tests := []struct {
+		name    string
+		summary sessionSummary
+		want    bool
+	}{
+		{name: "no summary", summary: sessionSummary{}, want: true},
+		{name: "covers a message of the branch", summary: sessionSummary{text: "s", coveredID: 4}, want: true},
+		{name: "covers a message of another branch", summary: sessionSummary{text: "s", coveredID: 3}, want: false},
+		{name: "covers a later message", summary: sessionSummary{text: "s", coveredID: 9}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summaryOnBranch(tt.summary, branch); got != tt.want {
+				t.Errorf("summaryOnBranch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
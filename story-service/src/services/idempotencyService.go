@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+const (
+	// IdempotencyWindow is how long a stored response is replayed
+	IdempotencyWindow = 24 * time.Hour
+	// MaxIdempotencyKeyLength bounds the Idempotency-Key header
+	MaxIdempotencyKeyLength = 255
+)
+
+var (
+	ErrInvalidIdempotencyKey  = errors.New("invalid idempotency key")
+	ErrIdempotencyKeyInUse    = errors.New("a request with this idempotency key is still running")
+	ErrIdempotencyKeyMismatch = errors.New("idempotency key was used with a different request")
+)
+
+// idempotencyInProgress is the status of a key whose request is running.
+// A key left in progress by a crashed instance is taken over after
+// idempotencyLockTimeout. A request with the key of a running request polls
+// every idempotencyPollInterval for up to idempotencyWait.
+const (
+	idempotencyInProgress   = 0
+	idempotencyLockTimeout  = 10 * time.Minute
+	idempotencyWait         = 30 * time.Second
+	idempotencyPollInterval = 250 * time.Millisecond
+)
+
+// IdempotentResponse is the stored response of a request made with an
+// idempotency key
+type IdempotentResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// BeginIdempotentRequest claims the key for a request whose method, path and
+// body hash to requestHash. It returns the stored response when the same
+// request already succeeded and ErrIdempotencyKeyMismatch when the key was
+// used for another request. While the same request is running, it waits for
+// it to finish and replays its response, or claims the key when it failed.
+// ErrIdempotencyKeyInUse is returned when the wait runs out. Once claimed,
+// the key is released with ReleaseIdempotencyKey or completed with
+// SaveIdempotentResponse.
+func BeginIdempotentRequest(ctx context.Context, userID, key, requestHash string) (*IdempotentResponse, error) {
+	if key == "" || len(key) > MaxIdempotencyKeyLength {
+		return nil, ErrInvalidIdempotencyKey
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, idempotencyWait)
+	defer cancel()
+	ticker := time.NewTicker(idempotencyPollInterval)
+	defer ticker.Stop()
+	for {
+		stored, err := beginIdempotentRequest(userID, key, requestHash)
+		if err != ErrIdempotencyKeyInUse {
+			return stored, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrIdempotencyKeyInUse
+		case <-ticker.C:
+		}
+	}
+}
+
+// beginIdempotentRequest makes one attempt of BeginIdempotentRequest
+func beginIdempotentRequest(userID, key, requestHash string) (*IdempotentResponse, error) {
+
+	// A new key, an expired response or an abandoned request can be claimed
+	now := time.Now()
+	stmt := `INSERT INTO idempotency_keys(user_id, key, request_hash, status, content_type, body)
+	VALUES ($1, $2, $3, $4, '', '')
+	ON CONFLICT (user_id, key) DO UPDATE SET
+		request_hash = EXCLUDED.request_hash, status = EXCLUDED.status,
+		content_type = '', body = '', created_at = CURRENT_TIMESTAMP
+	WHERE idempotency_keys.created_at <= $5
+	OR (idempotency_keys.status = $4 AND idempotency_keys.created_at <= $6)
+	RETURNING 1`
+	claimed := 0
+	err := models.Db.QueryRow(stmt, userID, key, requestHash, idempotencyInProgress,
+		now.Add(-IdempotencyWindow), now.Add(-idempotencyLockTimeout)).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	stmt = `SELECT request_hash, status, content_type, body FROM idempotency_keys
+	WHERE user_id = $1 AND key = $2`
+	storedHash := ""
+	r := IdempotentResponse{}
+	err = models.Db.QueryRow(stmt, userID, key).Scan(&storedHash, &r.Status, &r.ContentType, &r.Body)
+	if err == sql.ErrNoRows {
+		// Released in between, the retry can claim it
+		return nil, ErrIdempotencyKeyInUse
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Responses stored before requests were hashed match any request
+	if storedHash != "" && storedHash != requestHash {
+		return nil, ErrIdempotencyKeyMismatch
+	}
+	if r.Status == idempotencyInProgress {
+		return nil, ErrIdempotencyKeyInUse
+	}
+	return &r, nil
+}
+
+// ReleaseIdempotencyKey frees a claimed key whose request failed, so that it
+// can be retried
+func ReleaseIdempotencyKey(userID, key string) error {
+	stmt := "DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND status = $3"
+	_, err := models.Db.Exec(stmt, userID, key, idempotencyInProgress)
+	return err
+}
+
+// SaveIdempotentResponse stores the response of a claimed key
+func SaveIdempotentResponse(userID, key string, r IdempotentResponse) error {
+	stmt := `UPDATE idempotency_keys SET status = $3, content_type = $4, body = $5, created_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND key = $2`
+	_, err := models.Db.Exec(stmt, userID, key, r.Status, r.ContentType, r.Body)
+	return err
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"sync"
+
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+// jobSubscriberBuffer is how many updates a slow subscriber may lag behind
+// before further updates to it are dropped
+const jobSubscriberBuffer = 16
+
+type jobSubscriber struct {
+	userID    string
+	sessionID string
+	updates   chan *models.Job
+}
+
+var jobSubscribers = struct {
+	sync.Mutex
+	subs map[*jobSubscriber]struct{}
+}{subs: map[*jobSubscriber]struct{}{}}
+
+// SubscribeJobs returns the updates of the session's jobs run by this
+// instance. The returned function ends the subscription.
+func SubscribeJobs(userID, sessionID string) (<-chan *models.Job, func()) {
+	sub := &jobSubscriber{userID: userID, sessionID: sessionID, updates: make(chan *models.Job, jobSubscriberBuffer)}
+	jobSubscribers.Lock()
+	jobSubscribers.subs[sub] = struct{}{}
+	jobSubscribers.Unlock()
+
+	var once sync.Once
+	return sub.updates, func() {
+		once.Do(func() {
+			jobSubscribers.Lock()
+			delete(jobSubscribers.subs, sub)
+			jobSubscribers.Unlock()
+			close(sub.updates)
+		})
+	}
+}
+
+func publishJob(userID string, job *models.Job) {
+	jobSubscribers.Lock()
+	defer jobSubscribers.Unlock()
+	for sub := range jobSubscribers.subs {
+		if sub.userID != userID || sub.sessionID != job.SessionID {
+			continue
+		}
+		select {
+		case sub.updates <- job:
+		default:
+		}
+	}
+}
@@ -0,0 +1,628 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/lib/pq"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobLost is returned to a worker whose job was queued again after
+	// its heartbeat stopped, or was deleted with its session
+	ErrJobLost = errors.New("job is no longer run by this worker")
+)
+
+const (
+	defaultJobWorkers = 4
+	jobPollInterval   = 5 * time.Second
+	// jobTimeout bounds a job run, chunkedJobTimeout the run of a long PDF
+	// read in parts
+	jobTimeout        = 10 * time.Minute
+	chunkedJobTimeout = 30 * time.Minute
+	// Running jobs refresh updated_at every jobHeartbeat. Running jobs not
+	// refreshed for jobStaleAfter were lost with their worker and are queued
+	// again.
+	jobHeartbeat  = 30 * time.Second
+	jobStaleAfter = 2 * time.Minute
+	// A job failing with a retryable error is queued again after
+	// jobRetryBackoff, doubled with every attempt, until maxJobAttempts
+	jobRetryBackoff = 30 * time.Second
+	maxJobAttempts  = 3
+)
+
+// jobWake tells idle workers a job was queued
+var jobWake chan struct{}
+
+// runningJob lets a job run by this instance be stopped
+type runningJob struct {
+	sessionID string
+	cancel    context.CancelCauseFunc
+}
+
+// runningJobs are the jobs run by this instance by job ID
+var runningJobs = struct {
+	sync.Mutex
+	jobs map[string]runningJob
+}{jobs: map[string]runningJob{}}
+
+// uploadJob is an upload_jobs row with what a worker needs to run it
+type uploadJob struct {
+	models.Job
+	userID   string
+	fileIDs  []int64
+	mimeType string
+	options  StoryOptions
+	// newSession tells the upload created the session, a failed job then
+	// removes it with the files
+	newSession bool
+}
+
+const jobColumns = "id, session_id, status, result, error, error_code, attempts, " +
+	"progress_done, progress_total, created_at, updated_at"
+
+// scanJob scans jobColumns, after the columns scanned into extra
+func scanJob(row rowScanner, extra ...interface{}) (*models.Job, error) {
+	job := models.Job{}
+	result := sql.NullString{}
+	errorCode := ""
+	progress := models.JobProgress{}
+	dest := append(extra, &job.ID, &job.SessionID, &job.Status, &result, &job.Error, &errorCode,
+		&job.Attempts, &progress.Done, &progress.Total, &job.CreatedAt, &job.UpdatedAt)
+	err := row.Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result.Valid {
+		job.Story = &models.Message{Sender: "model", Content: result.String}
+	}
+	job.ErrorCode = models.ErrorCode(errorCode)
+	if progress.Total > 0 {
+		job.Progress = &progress
+	}
+	return &job, nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateUploadJob queues the story generation of uploaded files, one story
+// for all of them. newSession tells the upload created the session.
+func CreateUploadJob(
+	userID, sessionID string,
+	fileIDs []int64,
+	mimeType string,
+	opts StoryOptions,
+	newSession bool,
+) (*models.Job, error) {
+	if len(fileIDs) == 0 {
+		return nil, errors.New("job has no files")
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `INSERT INTO upload_jobs(id, user_id, session_id, file_id, file_ids, mime_type, options, status, new_session)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING ` + jobColumns
+	job, err := scanJob(models.Db.QueryRow(stmt, id, userID, sessionID, fileIDs[0], pq.Array(fileIDs),
+		mimeType, options, models.JobQueued, newSession))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// GetJob returns a job of the user
+func GetJob(userID, jobID string) (*models.Job, error) {
+	stmt := "SELECT " + jobColumns + " FROM upload_jobs WHERE user_id = $1 AND id = $2"
+	return scanJob(models.Db.QueryRow(stmt, userID, jobID))
+}
+
+// ListActiveJobs returns the queued and running jobs of a session
+func ListActiveJobs(userID, sessionID string) ([]*models.Job, error) {
+	stmt := "SELECT " + jobColumns + ` FROM upload_jobs
+	WHERE user_id = $1 AND session_id = $2 AND status IN ($3, $4)
+	ORDER BY created_at`
+	rows, err := models.Db.Query(stmt, userID, sessionID, models.JobQueued, models.JobRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*models.Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// StartJobWorkers starts the pool of JOB_WORKERS workers that run upload
+// jobs. Jobs are claimed from the database, so queued jobs survive a restart.
+func StartJobWorkers() error {
+	workers := defaultJobWorkers
+	if value := os.Getenv("JOB_WORKERS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid JOB_WORKERS %q", value)
+		}
+		workers = n
+	}
+
+	jobWake = make(chan struct{}, workers)
+	for i := 0; i < workers; i++ {
+		go runJobWorker()
+	}
+	log.Printf("started %d job workers", workers)
+	return nil
+}
+
+func runJobWorker() {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := claimJob()
+		if err != nil {
+			log.Printf("could not claim job: %v", err)
+		}
+		if job != nil {
+			runJob(job)
+			continue
+		}
+
+		select {
+		case <-jobWake:
+		case <-ticker.C:
+			if err := requeueStaleJobs(); err != nil {
+				log.Printf("could not requeue stale jobs: %v", err)
+			}
+		}
+	}
+}
+
+// claimJob marks the oldest queued job as running and returns it, or nil
+// when there is none. SKIP LOCKED lets several instances share the queue.
+func claimJob() (*uploadJob, error) {
+	stmt := `UPDATE upload_jobs SET status = $1, attempts = attempts + 1,
+		started_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM upload_jobs
+		WHERE status = $2 AND (run_after IS NULL OR run_after <= CURRENT_TIMESTAMP)
+		ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED
+	)
+	RETURNING user_id, file_ids, mime_type, options, new_session, ` + jobColumns
+
+	job := uploadJob{}
+	options := []byte{}
+	claimed, err := scanJob(models.Db.QueryRow(stmt, models.JobRunning, models.JobQueued),
+		&job.userID, pq.Array(&job.fileIDs), &job.mimeType, &options, &job.newSession)
+	if err == ErrJobNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.Job = *claimed
+	if err := json.Unmarshal(options, &job.options); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// requeueStaleJobs queues again the jobs whose worker went away, or fails
+// them once they used up their attempts
+func requeueStaleJobs() error {
+	stale := time.Now().Add(-jobStaleAfter)
+	stmt := `UPDATE upload_jobs SET status = $1, updated_at = CURRENT_TIMESTAMP
+	WHERE status = $2 AND updated_at < $3 AND attempts < $4`
+	if _, err := models.Db.Exec(stmt, models.JobQueued, models.JobRunning, stale, maxJobAttempts); err != nil {
+		return err
+	}
+
+	stmt = `SELECT user_id, file_ids, new_session, ` + jobColumns + ` FROM upload_jobs
+	WHERE status = $1 AND updated_at < $2 AND attempts >= $3`
+	rows, err := models.Db.Query(stmt, models.JobRunning, stale, maxJobAttempts)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	exhausted := []*uploadJob{}
+	for rows.Next() {
+		job := uploadJob{}
+		stale, err := scanJob(rows, &job.userID, pq.Array(&job.fileIDs), &job.newSession)
+		if err != nil {
+			return err
+		}
+		job.Job = *stale
+		exhausted = append(exhausted, &job)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, job := range exhausted {
+		failJob(context.Background(), job, errors.New("job did not finish"), models.ErrorCodeInternal)
+	}
+	return nil
+}
+
+// runJob generates the story of the job's files and saves it as the first
+// model message of the session. A job failing with a retryable error is
+// queued again. A failed job leaves neither the file nor a message behind,
+// so the upload can be retried.
+func runJob(job *uploadJob) {
+	publishJob(job.userID, &job.Job)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	runningJobs.Lock()
+	runningJobs.jobs[job.ID] = runningJob{sessionID: job.SessionID, cancel: cancel}
+	runningJobs.Unlock()
+	defer func() {
+		runningJobs.Lock()
+		delete(runningJobs.jobs, job.ID)
+		runningJobs.Unlock()
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go heartbeatJob(job, cancel, stop)
+
+	content, err := generateJobStory(ctx, job)
+	if err == nil {
+		err = completeJob(job, content)
+	}
+	if err == nil {
+		return
+	}
+	if errors.Is(context.Cause(ctx), ErrJobLost) {
+		err = ErrJobLost
+	}
+	if errors.Is(err, ErrJobLost) {
+		log.Printf("job %s attempt %d was given up: %v", job.ID, job.Attempts, err)
+		return
+	}
+	code := GenerationErrorCode(err)
+	if isTransientError(err) && job.Attempts < maxJobAttempts {
+		log.Printf("job %s failed on attempt %d, retrying: %v", job.ID, job.Attempts, err)
+		retryErr := retryJob(job)
+		if retryErr == nil || errors.Is(retryErr, ErrJobLost) {
+			return
+		}
+		log.Printf("could not retry job %s: %v", job.ID, retryErr)
+	}
+	log.Printf("job %s failed: %v", job.ID, err)
+	failJob(ctx, job, err, code)
+}
+
+// runningJobCondition matches the job only while it is running the attempt
+// the worker claimed
+const runningJobCondition = "id = $1 AND status = $2 AND attempts = $3"
+
+// heartbeatJob refreshes updated_at of a running job until stop is closed,
+// so that it is not taken for a lost job. A job that was queued again or
+// deleted by another instance is cancelled with ErrJobLost.
+func heartbeatJob(job *uploadJob, cancel context.CancelCauseFunc, stop <-chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			stmt := "UPDATE upload_jobs SET updated_at = CURRENT_TIMESTAMP WHERE " + runningJobCondition
+			res, err := models.Db.Exec(stmt, job.ID, models.JobRunning, job.Attempts)
+			if err != nil {
+				log.Printf("could not refresh job %s: %v", job.ID, err)
+				continue
+			}
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				cancel(ErrJobLost)
+				return
+			}
+		}
+	}
+}
+
+// cancelSessionJobs stops the jobs of the session run by this instance,
+// other instances notice the deleted jobs on their next heartbeat
+func cancelSessionJobs(sessionID string) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	for _, job := range runningJobs.jobs {
+		if job.sessionID == sessionID {
+			job.cancel(ErrJobLost)
+		}
+	}
+}
+
+// isTransientError reports whether a failed job may succeed when run again:
+// network failures, timeouts, rate limits and server errors of the model's
+// API. Anything else fails the job right away.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var openaiErr *openaiAPIError
+	if errors.As(err, &openaiErr) {
+		return openaiErr.StatusCode == http.StatusTooManyRequests || openaiErr.StatusCode >= http.StatusInternalServerError
+	}
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return googleErr.Code == http.StatusTooManyRequests || googleErr.Code >= http.StatusInternalServerError
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// retryJob queues the job again to run after a backoff
+func retryJob(job *uploadJob) error {
+	backoff := jobRetryBackoff << (job.Attempts - 1)
+	stmt := `UPDATE upload_jobs SET status = $4, run_after = $5, updated_at = CURRENT_TIMESTAMP
+	WHERE ` + runningJobCondition + ` RETURNING ` + jobColumns
+	queued, err := scanJob(models.Db.QueryRow(stmt, job.ID, models.JobRunning, job.Attempts, models.JobQueued, time.Now().Add(backoff)))
+	if err == ErrJobNotFound {
+		return ErrJobLost
+	}
+	if err != nil {
+		return err
+	}
+	publishJob(job.userID, queued)
+	return nil
+}
+
+// buildJobPrompt builds the story prompt of an upload, with the metadata of
+// a single file
+func buildJobPrompt(userID, sessionID string, fileIDs []int64, mimeType string, opts StoryOptions) (*StoryPrompt, error) {
+	prompt, err := BuildStoryPrompt(opts, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	if len(fileIDs) == 1 && !opts.Album {
+		details, err := fileDetails(userID, sessionID, fileIDs[0])
+		if err != nil {
+			return nil, err
+		}
+		if details != "" {
+			prompt.Text += "\n\nWhat the file tells about itself: " + details + "."
+		}
+	}
+	return prompt, nil
+}
+
+func generateJobStory(parent context.Context, job *uploadJob) (string, error) {
+	ctx, cancel := context.WithTimeout(parent, jobTimeout)
+	defer cancel()
+
+	prompt, err := buildJobPrompt(job.userID, job.SessionID, job.fileIDs, job.mimeType, job.options)
+	if err != nil {
+		return "", err
+	}
+
+	var resp *genai.GenerateContentResponse
+	if len(job.fileIDs) == 1 && !job.options.Album {
+		data, err := loadFileData(ctx, job.userID, job.fileIDs[0])
+		if err != nil {
+			return "", err
+		}
+
+		chunks, err := splitLongPDF(data, job.mimeType)
+		if err != nil {
+			return "", err
+		}
+		if chunks != nil {
+			chunkCtx, cancelChunks := context.WithTimeout(parent, chunkedJobTimeout)
+			defer cancelChunks()
+			resp, err = generateChunkedContent(chunkCtx, job, chunks, prompt)
+		} else {
+			resp, err = GenerateContentFromData(ctx, data, job.mimeType, prompt)
+		}
+	} else {
+		resp, err = generateAlbumContent(ctx, job.userID, job.SessionID, job.fileIDs, prompt)
+	}
+	if resp != nil {
+		RecordUsage(job.userID, job.SessionID, UsageStory, resp.UsageMetadata)
+	}
+	if err != nil {
+		return "", err
+	}
+	return ParseContentResponse(resp)
+}
+
+// storyPrompt rebuilds the prompt of the story saved as the message
+// messageID by an upload job. Stories saved before jobs get the default
+// prompt for the session's source file.
+func storyPrompt(userID, sessionID string, messageID int64) (string, error) {
+	mimeType := ""
+	options := []byte{}
+	fileIDs := []int64{}
+	stmt := "SELECT mime_type, options, file_ids FROM upload_jobs WHERE user_id = $1 AND session_id = $2 AND message_id = $3"
+	err := models.Db.QueryRow(stmt, userID, sessionID, messageID).Scan(&mimeType, &options, pq.Array(&fileIDs))
+	opts := StoryOptions{}
+	switch {
+	case err == sql.ErrNoRows:
+		session, err := GetSession(userID, sessionID)
+		if err != nil {
+			return "", err
+		}
+		if session.FileID == nil {
+			return "", ErrNothingToRegenerate
+		}
+		fileIDs = []int64{*session.FileID}
+		stmt := "SELECT content_type FROM session_files WHERE user_id = $1 AND id = $2"
+		if err := models.Db.QueryRow(stmt, userID, fileIDs[0]).Scan(&mimeType); err != nil {
+			return "", err
+		}
+	case err != nil:
+		return "", err
+	default:
+		if err := json.Unmarshal(options, &opts); err != nil {
+			return "", err
+		}
+	}
+
+	prompt, err := buildJobPrompt(userID, sessionID, fileIDs, mimeType, opts)
+	if err != nil {
+		return "", err
+	}
+	return prompt.Text, nil
+}
+
+// completeJob saves the story and marks the job as succeeded in one
+// transaction, so a job is never run again after its story was saved. The
+// job is marked first, a worker that lost the job saves nothing.
+func completeJob(job *uploadJob, content string) error {
+	tx, err := models.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	finished, err := updateJob(tx, job, models.JobSucceeded, sql.NullString{String: content, Valid: true}, "", "")
+	if err != nil {
+		return err
+	}
+	messageID, err := saveMessage(tx, job.userID, job.SessionID, models.Message{Content: content, Sender: "model"})
+	if err != nil {
+		return err
+	}
+	// The story is found again by its job to be regenerated
+	if _, err := tx.Exec("UPDATE upload_jobs SET message_id = $1 WHERE id = $2", messageID, job.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	publishJob(job.userID, finished)
+	return nil
+}
+
+// failJob marks the job as failed and deletes the files it was created for,
+// and the session when the upload created it. The upload does not count
+// against the user's quota.
+func failJob(ctx context.Context, job *uploadJob, jobErr error, code models.ErrorCode) {
+	tx, err := models.Db.Begin()
+	if err != nil {
+		log.Printf("could not fail job %s: %v", job.ID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	keys := []sql.NullString{}
+	for _, fileID := range job.fileIDs {
+		key, err := deleteFile(tx, job.userID, job.SessionID, fileID)
+		if err != nil {
+			log.Printf("could not delete files of job %s: %v", job.ID, err)
+			return
+		}
+		keys = append(keys, key)
+	}
+	if job.newSession {
+		if err := deleteEmptySession(tx, job.userID, job.SessionID); err != nil {
+			log.Printf("could not delete session of job %s: %v", job.ID, err)
+			return
+		}
+	}
+	failed, err := updateJob(tx, job, models.JobFailed, sql.NullString{}, jobErr.Error(), code)
+	if err != nil {
+		log.Printf("could not fail job %s: %v", job.ID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("could not fail job %s: %v", job.ID, err)
+		return
+	}
+	// The job context may be what timed out
+	for _, key := range keys {
+		deleteFileBlob(context.WithoutCancel(ctx), key)
+	}
+	RefundUpload(context.WithoutCancel(ctx), job.userID, job.CreatedAt)
+	publishJob(job.userID, failed)
+}
+
+// setJobProgress records how many parts of a job are done
+func setJobProgress(job *uploadJob, done, total int) {
+	stmt := `UPDATE upload_jobs SET progress_done = $4, progress_total = $5, updated_at = CURRENT_TIMESTAMP
+	WHERE ` + runningJobCondition + ` RETURNING ` + jobColumns
+	updated, err := scanJob(models.Db.QueryRow(stmt, job.ID, models.JobRunning, job.Attempts, done, total))
+	if err != nil {
+		log.Printf("could not update progress of job %s: %v", job.ID, err)
+		return
+	}
+	publishJob(job.userID, updated)
+}
+
+// updateJob finishes the attempt of the job the worker claimed. It returns
+// ErrJobLost when the job no longer runs that attempt.
+func updateJob(
+	tx *sql.Tx,
+	job *uploadJob,
+	status models.JobStatus,
+	result sql.NullString,
+	message string,
+	code models.ErrorCode,
+) (*models.Job, error) {
+	stmt := `UPDATE upload_jobs SET status = $4, result = $5, error = $6, error_code = $7,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE ` + runningJobCondition + ` RETURNING ` + jobColumns
+	updated, err := scanJob(tx.QueryRow(stmt, job.ID, models.JobRunning, job.Attempts, status, result, message, code))
+	if err == ErrJobNotFound {
+		return nil, ErrJobLost
+	}
+	return updated, err
+}
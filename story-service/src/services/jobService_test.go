@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "deadline", err: fmt.Errorf("generating: %w", context.DeadlineExceeded), want: true},
+		{name: "canceled", err: context.Canceled, want: false},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+		{name: "openai rate limit", err: &openaiAPIError{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "openai server error", err: &openaiAPIError{StatusCode: http.StatusBadGateway}, want: true},
+		{name: "openai bad request", err: &openaiAPIError{StatusCode: http.StatusBadRequest}, want: false},
+		{name: "google server error", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, want: true},
+		{name: "google forbidden", err: &googleapi.Error{Code: http.StatusForbidden}, want: false},
+		{name: "grpc unavailable", err: status.Error(codes.Unavailable, "down"), want: true},
+		{name: "grpc quota", err: status.Error(codes.ResourceExhausted, "quota"), want: true},
+		{name: "grpc invalid argument", err: status.Error(codes.InvalidArgument, "bad"), want: false},
+		{name: "blocked response", err: &GenerationError{Err: ErrResponseBlocked}, want: false},
+		{name: "unsupported content", err: ErrUnsupportedMediaType, want: false},
+		{name: "blob missing", err: ErrBlobNotFound, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.want {
+				t.Errorf("isTransientError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelSessionJobs(t *testing.T) {
+	contexts := map[string]context.Context{}
+	for id, sessionID := range map[string]string{"j1": "s1", "j2": "s1", "j3": "s2"} {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		defer cancel(nil)
+		contexts[id] = ctx
+		runningJobs.Lock()
+		runningJobs.jobs[id] = runningJob{sessionID: sessionID, cancel: cancel}
+		runningJobs.Unlock()
+	}
+	t.Cleanup(func() {
+		runningJobs.Lock()
+		runningJobs.jobs = map[string]runningJob{}
+		runningJobs.Unlock()
+	})
+
+	cancelSessionJobs("s1")
+	for id, wantLost := range map[string]bool{"j1": true, "j2": true, "j3": false} {
+		if lost := errors.Is(context.Cause(contexts[id]), ErrJobLost); lost != wantLost {
+			t.Errorf("job %s lost = %v, want %v", id, lost, wantLost)
+		}
+	}
+}
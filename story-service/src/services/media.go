@@ -0,0 +1,213 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// MaxUploadSize bounds the body of an upload request, it leaves room for
+// an album of maxAlbumSize
+const MaxUploadSize = 256 << 20
+
+var (
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	ErrMediaTypeMismatch    = errors.New("file content does not match its extension or content type")
+)
+
+// supportedMediaTypes are the MIME types accepted for story generation.
+// Detected types are compared with MIME.Is so aliases also match.
+var supportedMediaTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"application/pdf",
+	"video/mp4",
+	"video/quicktime",
+	"video/webm",
+	"audio/mpeg",
+	"audio/wav",
+	"audio/mp4",
+	"audio/ogg",
+	MimeTypeText,
+	MimeTypeHTML,
+	MimeTypeDOCX,
+	MimeTypeODT,
+}
+
+// mediaTypeAliases maps detected types that are not aliases in the mimetype
+// tree to the supported type they stand for
+var mediaTypeAliases = map[string]string{
+	"audio/x-m4a":     "audio/mp4",
+	"application/ogg": "audio/ogg",
+}
+
+// mediaExtensions maps the supported upload extensions to the MIME types their
+// content may have
+var mediaExtensions = map[string][]string{
+	".jpg":      {"image/jpeg"},
+	".jpeg":     {"image/jpeg"},
+	".png":      {"image/png"},
+	".pdf":      {"application/pdf"},
+	".mp4":      {"video/mp4", "audio/mp4"},
+	".mov":      {"video/quicktime"},
+	".webm":     {"video/webm"},
+	".mp3":      {"audio/mpeg"},
+	".wav":      {"audio/wav"},
+	".m4a":      {"audio/mp4"},
+	".ogg":      {"audio/ogg"},
+	".txt":      {MimeTypeText},
+	".md":       {MimeTypeMarkdown},
+	".markdown": {MimeTypeMarkdown},
+	".html":     {MimeTypeHTML},
+	".htm":      {MimeTypeHTML},
+	".docx":     {MimeTypeDOCX},
+	".odt":      {MimeTypeODT},
+}
+
+// textExtensions name the type of text content, which has no magic bytes to
+// tell plain text, Markdown and HTML apart. Text without one of them is not
+// accepted.
+var textExtensions = map[string]string{
+	".txt":      MimeTypeText,
+	".md":       MimeTypeMarkdown,
+	".markdown": MimeTypeMarkdown,
+	".html":     MimeTypeHTML,
+	".htm":      MimeTypeHTML,
+}
+
+// declaredTypeAliases maps nonstandard types clients send to the standard
+// type they stand for
+var declaredTypeAliases = map[string]string{
+	"image/jpg":       "image/jpeg",
+	"image/pjpeg":     "image/jpeg",
+	"audio/mp3":       "audio/mpeg",
+	"audio/x-wav":     "audio/wav",
+	"audio/wave":      "audio/wav",
+	"text/x-markdown": MimeTypeMarkdown,
+}
+
+// DetectMediaType returns the supported MIME type of data from its magic bytes.
+// If filename has a known extension, the content must agree with it.
+func DetectMediaType(data []byte, filename string) (string, error) {
+	return matchMediaType(mimetype.Detect(data), filename, "")
+}
+
+// DetectFileType is like DetectMediaType for an uploaded file. The content
+// must also agree with the Content-Type of its part, and the model of the
+// configured provider must read the type.
+func DetectFileType(file *multipart.FileHeader) (string, error) {
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	detected, err := mimetype.DetectReader(f)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	mimeType, err := matchMediaType(detected, file.Filename, file.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
+	if err := CheckGeneratorMediaType(mimeType); err != nil {
+		return "", err
+	}
+	return mimeType, nil
+}
+
+// matchMediaType returns the supported type of the detected content, after
+// checking it against the extension of filename and the declared
+// Content-Type. An empty declared type is not checked.
+func matchMediaType(detected *mimetype.MIME, filename, declared string) (string, error) {
+	mimeType, err := extensionMediaType(detected, filename)
+	if err != nil {
+		return "", err
+	}
+	if !declaredTypeMatches(declared, detected, mimeType) {
+		return "", fmt.Errorf("%w: %s sent as %s", ErrMediaTypeMismatch, mimeType, declared)
+	}
+	return mimeType, nil
+}
+
+// extensionMediaType returns the supported type of the detected content,
+// which must agree with the extension of filename
+func extensionMediaType(detected *mimetype.MIME, filename string) (string, error) {
+	mimeType := ""
+	for m := detected; m != nil && mimeType == ""; m = m.Parent() {
+		if alias, ok := mediaTypeAliases[m.String()]; ok {
+			mimeType = alias
+			break
+		}
+		for _, supported := range supportedMediaTypes {
+			if m.Is(supported) {
+				mimeType = supported
+				break
+			}
+		}
+	}
+	if mimeType == "" {
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedMediaType, detected.String())
+	}
+
+	ext := strings.ToLower(filepath.Ext(filename))
+	if mimeType == MimeTypeText || mimeType == MimeTypeHTML {
+		textType, ok := textExtensions[ext]
+		if !ok && mimeType == MimeTypeText {
+			return "", fmt.Errorf("%w: text file with extension %q", ErrUnsupportedMediaType, ext)
+		}
+		if ok {
+			return textType, nil
+		}
+	}
+	if expected, ok := mediaExtensions[ext]; ok {
+		for _, t := range expected {
+			if t == mimeType {
+				return mimeType, nil
+			}
+		}
+		return "", fmt.Errorf("%w: %s file contains %s", ErrMediaTypeMismatch, ext, mimeType)
+	}
+	return mimeType, nil
+}
+
+// declaredTypeMatches reports whether the Content-Type a client declared
+// agrees with the detected content. Clients that do not know the type send
+// none or application/octet-stream, which agrees with any content. The
+// declared type may be one the detected type derives from, a DOCX file sent
+// as application/zip or Markdown sent as text/plain.
+func declaredTypeMatches(declared string, detected *mimetype.MIME, mimeType string) bool {
+	if declared == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(declared)
+	if err != nil {
+		return false
+	}
+	if mediaType == "application/octet-stream" {
+		return true
+	}
+	if alias, ok := declaredTypeAliases[mediaType]; ok {
+		mediaType = alias
+	}
+	if mediaType == mimeType || mediaTypeAliases[mediaType] == mimeType {
+		return true
+	}
+	for m := detected; m != nil; m = m.Parent() {
+		if m.Is(mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTimedMedia reports whether the MIME type is video or audio
+func isTimedMedia(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "video/") || strings.HasPrefix(mimeType, "audio/")
+}
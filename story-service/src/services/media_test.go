@@ -0,0 +1,56 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+func TestMatchMediaType(t *testing.T) {
+	var (
+		png  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+		jpeg = []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00")
+		pdf  = []byte("%PDF-1.7\n")
+		text = []byte("Once upon a time\n")
+		page = []byte("<!DOCTYPE html><html><body>hi</body></html>")
+	)
+	tests := []struct {
+		name     string
+		data     []byte
+		filename string
+		declared string
+		want     string
+		wantErr  error
+	}{
+		{name: "png", data: png, filename: "photo.png", want: "image/png"},
+		{name: "extension is case insensitive", data: jpeg, filename: "IMG.JPG", want: "image/jpeg"},
+		{name: "unknown extension is not checked", data: pdf, filename: "scan.bin", want: "application/pdf"},
+		{name: "content disagrees with extension", data: png, filename: "photo.jpg", wantErr: ErrMediaTypeMismatch},
+		{name: "unsupported content", data: []byte("GIF89a"), filename: "anim.gif", wantErr: ErrUnsupportedMediaType},
+		{name: "text needs a text extension", data: text, filename: "notes", wantErr: ErrUnsupportedMediaType},
+		{name: "text file", data: text, filename: "notes.txt", want: MimeTypeText},
+		{name: "markdown by extension", data: text, filename: "notes.md", want: MimeTypeMarkdown},
+		{name: "html", data: page, filename: "page.html", want: MimeTypeHTML},
+		{name: "html without extension", data: page, filename: "page", want: MimeTypeHTML},
+		{name: "declared type matches", data: png, filename: "photo.png", declared: "image/png", want: "image/png"},
+		{name: "declared type with parameters", data: text, filename: "a.txt", declared: "text/plain; charset=utf-8", want: MimeTypeText},
+		{name: "declared alias", data: jpeg, filename: "a.jpg", declared: "image/jpg", want: "image/jpeg"},
+		{name: "declared markdown", data: text, filename: "a.md", declared: "text/markdown", want: MimeTypeMarkdown},
+		{name: "declared nonstandard markdown", data: text, filename: "a.md", declared: "text/x-markdown", want: MimeTypeMarkdown},
+		{name: "declared octet stream", data: pdf, filename: "a.pdf", declared: "application/octet-stream", want: "application/pdf"},
+		{name: "declared type differs", data: png, filename: "photo.png", declared: "image/jpeg", wantErr: ErrMediaTypeMismatch},
+		{name: "declared type is malformed", data: png, filename: "photo.png", declared: "image/", wantErr: ErrMediaTypeMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchMediaType(mimetype.Detect(tt.data), tt.filename, tt.declared)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("matchMediaType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
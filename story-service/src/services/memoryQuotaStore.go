@@ -0,0 +1,45 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type quotaCounter struct {
+	start time.Time
+	count int64
+}
+
+// memoryQuotaStore keeps the counters in the process. They are lost on
+// restart and not shared between instances.
+type memoryQuotaStore struct {
+	mu       sync.Mutex
+	counters map[string]quotaCounter
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{counters: map[string]quotaCounter{}}
+}
+
+func (s *memoryQuotaStore) Add(ctx context.Context, key string, start time.Time, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counter := s.counters[key]
+	if !counter.start.Equal(start) {
+		counter = quotaCounter{start: start}
+	}
+	counter.count = max(counter.count+n, 0)
+	s.counters[key] = counter
+	return counter.count, nil
+}
+
+func (s *memoryQuotaStore) Get(ctx context.Context, key string, start time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counter := s.counters[key]
+	if !counter.start.Equal(start) {
+		return 0, nil
+	}
+	return counter.count, nil
+}
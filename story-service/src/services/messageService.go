@@ -0,0 +1,287 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+var (
+	ErrMessageNotFound     = errors.New("message not found")
+	ErrNotUserMessage      = errors.New("only user messages can be edited")
+	ErrNotModelMessage     = errors.New("the story can only be forked from a model message")
+	ErrNothingToRegenerate = errors.New("the last message is not a reply to a chat message")
+)
+
+// Rewind is a chat turn sent from an earlier point of the conversation: the
+// last prompt to regenerate its reply, an edited prompt, or a new prompt
+// forking the story from an earlier message. It starts a new branch of the
+// message tree, nothing changes in the session until Commit saves the reply.
+type Rewind struct {
+	userID, sessionID string
+	// parentID is the message the new prompt follows, 0 for the first one
+	parentID int64
+	// promptID is the existing prompt a regenerated reply answers
+	promptID int64
+	// story is set when a story written from uploaded files is regenerated,
+	// it follows parentID with no prompt saved before it
+	story bool
+
+	// Text is the prompt to send after History
+	Text    string
+	History []*genai.Content
+	// LastAttachment is the last session file in History
+	LastAttachment int64
+}
+
+// PrepareRegenerate rewinds the session to before the last reply of its
+// active branch. A story written from uploaded files is asked for again with
+// the prompt of its upload.
+func PrepareRegenerate(ctx context.Context, userID, sessionID string) (*Rewind, error) {
+	messages, err := loadStoredMessages(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	n := len(messages)
+	if n == 0 || messages[n-1].Sender != "model" {
+		return nil, ErrNothingToRegenerate
+	}
+	if n >= 2 && messages[n-2].Sender == "user" {
+		prompt := messages[n-2]
+		return prepareRewind(ctx, userID, sessionID, messages[:n-2], prompt.parentID, prompt.id, prompt.Content)
+	}
+
+	// The files of the story end the history before it, the prompt joins them
+	story := messages[n-1]
+	text, err := storyPrompt(userID, sessionID, story.id)
+	if err != nil {
+		return nil, err
+	}
+	rewind, err := prepareRewind(ctx, userID, sessionID, messages[:n-1], story.parentID, 0, text)
+	if err != nil {
+		return nil, err
+	}
+	rewind.story = true
+	return rewind, nil
+}
+
+// PrepareEdit rewinds the session to before the user message messageID, to
+// send text in its place
+func PrepareEdit(ctx context.Context, userID, sessionID, messageID, text string) (*Rewind, error) {
+	branch, err := loadMessageBranch(userID, sessionID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	message := branch[len(branch)-1]
+	if message.Sender != "user" {
+		return nil, ErrNotUserMessage
+	}
+	return prepareRewind(ctx, userID, sessionID, branch[:len(branch)-1], message.parentID, 0, text)
+}
+
+// PrepareFork rewinds the session to the model message parentID, to
+// continue the story from there with text. Prompts only follow replies, a
+// prompt after a prompt would reach the model merged with it.
+func PrepareFork(ctx context.Context, userID, sessionID, parentID, text string) (*Rewind, error) {
+	branch, err := loadMessageBranch(userID, sessionID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	if branch[len(branch)-1].Sender != "model" {
+		return nil, ErrNotModelMessage
+	}
+	return prepareRewind(ctx, userID, sessionID, branch, branch[len(branch)-1].id, 0, text)
+}
+
+// loadMessageBranch returns the branch ending with the message messageID
+func loadMessageBranch(userID, sessionID, messageID string) ([]storedMessage, error) {
+	id, err := strconv.ParseInt(messageID, 10, 64)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+	branch, err := loadBranch(userID, sessionID, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(branch) == 0 {
+		return nil, ErrMessageNotFound
+	}
+	return branch, nil
+}
+
+func prepareRewind(
+	ctx context.Context,
+	userID, sessionID string,
+	branch []storedMessage,
+	parentID, promptID int64,
+	text string,
+) (*Rewind, error) {
+	history, lastAttachment, err := loadChatHistory(ctx, userID, sessionID, branch)
+	if err != nil {
+		return nil, err
+	}
+	return &Rewind{
+		userID:         userID,
+		sessionID:      sessionID,
+		parentID:       parentID,
+		promptID:       promptID,
+		Text:           strings.TrimSpace(text),
+		History:        history,
+		LastAttachment: lastAttachment,
+	}, nil
+}
+
+// Commit saves the new reply, and the new prompt unless the reply is
+// regenerated, and makes their branch the active one
+func (r *Rewind) Commit(response string) error {
+	tx, err := models.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	replyParentID := r.promptID
+	switch {
+	case r.story:
+		replyParentID = r.parentID
+	case replyParentID == 0:
+		if replyParentID, err = insertMessage(tx, r.userID, r.sessionID, "user", r.Text, r.parentID); err != nil {
+			return err
+		}
+	}
+	replyID, err := insertMessage(tx, r.userID, r.sessionID, "model", response, replyParentID)
+	if err != nil {
+		return err
+	}
+	if err := activateBranch(tx, r.userID, r.sessionID, replyID); err != nil {
+		return err
+	}
+	if err := touchSession(tx, r.userID, r.sessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertMessage saves a message after the message parentID, or as a first
+// message when parentID is 0
+func insertMessage(tx *sql.Tx, userID, sessionID, sender, content string, parentID int64) (int64, error) {
+	parent := sql.NullInt64{Int64: parentID, Valid: parentID != 0}
+	stmt := `INSERT INTO chat_sessions(user_id, session_id, message, sender, parent_id)
+	VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	var id int64
+	err := tx.QueryRow(stmt, userID, sessionID, content, sender, parent).Scan(&id)
+	return id, err
+}
+
+// activateBranch makes the branch ending with leafID the active one
+func activateBranch(tx *sql.Tx, userID, sessionID string, leafID int64) error {
+	stmt := `WITH RECURSIVE branch AS (
+		SELECT id, parent_id FROM chat_sessions WHERE user_id = $1 AND session_id = $2 AND id = $3
+		UNION ALL
+		SELECT c.id, c.parent_id FROM chat_sessions c JOIN branch b ON c.id = b.parent_id
+		WHERE c.user_id = $1 AND c.session_id = $2
+	)
+	UPDATE chat_sessions SET active = id IN (SELECT id FROM branch)
+	WHERE user_id = $1 AND session_id = $2`
+	_, err := tx.Exec(stmt, userID, sessionID, leafID)
+	return err
+}
+
+// SwitchBranch makes the branch through the message messageID the active
+// one. The branch goes on to the latest message after it.
+func SwitchBranch(userID, sessionID, messageID string) error {
+	id, err := strconv.ParseInt(messageID, 10, 64)
+	if err != nil {
+		return ErrMessageNotFound
+	}
+	stmt := `WITH RECURSIVE subtree AS (
+		SELECT id FROM chat_sessions WHERE user_id = $1 AND session_id = $2 AND id = $3
+		UNION ALL
+		SELECT c.id FROM chat_sessions c JOIN subtree s ON c.parent_id = s.id
+		WHERE c.user_id = $1 AND c.session_id = $2
+	)
+	SELECT MAX(id) FROM subtree`
+	leafID := sql.NullInt64{}
+	if err := models.Db.QueryRow(stmt, userID, sessionID, id).Scan(&leafID); err != nil {
+		return err
+	}
+	if !leafID.Valid {
+		return ErrMessageNotFound
+	}
+
+	tx, err := models.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := activateBranch(tx, userID, sessionID, leafID.Int64); err != nil {
+		return err
+	}
+	if err := touchSession(tx, userID, sessionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const messageNodeColumns = "id, COALESCE(parent_id, 0), sender, message, active, timestamp"
+
+// ListMessageTree returns every message of a session, in the order they
+// were sent
+func ListMessageTree(userID, sessionID string) ([]*models.MessageNode, error) {
+	stmt := "SELECT " + messageNodeColumns + " FROM chat_sessions WHERE user_id = $1 AND session_id = $2 ORDER BY id"
+	return queryMessageNodes(stmt, userID, sessionID)
+}
+
+// ListMessageVersions returns the versions of a message, the messages
+// of the same sender that follow the same parent, oldest first
+func ListMessageVersions(userID, sessionID, messageID string) ([]*models.MessageNode, error) {
+	id, err := strconv.ParseInt(messageID, 10, 64)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+	stmt := "SELECT " + messageNodeColumns + ` FROM chat_sessions c
+	WHERE user_id = $1 AND session_id = $2 AND EXISTS (
+		SELECT 1 FROM chat_sessions m
+		WHERE m.user_id = $1 AND m.session_id = $2 AND m.id = $3
+		AND m.sender = c.sender AND m.parent_id IS NOT DISTINCT FROM c.parent_id
+	)
+	ORDER BY id`
+	versions, err := queryMessageNodes(stmt, userID, sessionID, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrMessageNotFound
+	}
+	return versions, nil
+}
+
+func queryMessageNodes(stmt string, args ...interface{}) ([]*models.MessageNode, error) {
+	rows, err := models.Db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := []*models.MessageNode{}
+	for rows.Next() {
+		node := models.MessageNode{}
+		var id, parentID int64
+		createdAt := sql.NullTime{}
+		if err := rows.Scan(&id, &parentID, &node.Sender, &node.Content, &node.Active, &createdAt); err != nil {
+			return nil, err
+		}
+		node.ID = strconv.FormatInt(id, 10)
+		if parentID != 0 {
+			node.ParentID = strconv.FormatInt(parentID, 10)
+		}
+		node.CreatedAt = createdAt.Time
+		nodes = append(nodes, &node)
+	}
+	return nodes, rows.Err()
+}
@@ -0,0 +1,206 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Metadata fields users can keep out of the prompts
+const (
+	MetadataTakenAt  = "taken_at"
+	MetadataCamera   = "camera"
+	MetadataLocation = "location"
+	MetadataAuthor   = "author"
+	MetadataTitle    = "title"
+)
+
+var MetadataFields = []string{MetadataTakenAt, MetadataCamera, MetadataLocation, MetadataAuthor, MetadataTitle}
+
+var ErrInvalidMetadataField = errors.New("invalid metadata field")
+
+const (
+	// maxMetadataText bounds text fields taken from files
+	maxMetadataText = 200
+	// maxEXIFChunk bounds the eXIf chunk of a PNG, larger ones are skipped
+	maxEXIFChunk = 64 << 10
+)
+
+// ExtractMetadata reads the metadata of a photo or PDF. Files without
+// metadata, or with metadata that cannot be read, give nil.
+func ExtractMetadata(r io.ReadSeeker, mimeType string) *models.FileMetadata {
+	var meta *models.FileMetadata
+	var err error
+	switch mimeType {
+	case "image/jpeg":
+		meta, err = exifMetadata(r)
+	case "image/png":
+		meta, err = pngMetadata(r)
+	case "application/pdf":
+		meta, err = pdfMetadata(r)
+	default:
+		return nil
+	}
+	if err != nil {
+		log.Printf("could not read %s metadata: %v", mimeType, err)
+		return nil
+	}
+	return meta
+}
+
+func exifMetadata(r io.Reader) (*models.FileMetadata, error) {
+	x, err := exif.Decode(r)
+	if err != nil {
+		// Most photos from messengers have their EXIF stripped
+		return nil, nil
+	}
+
+	meta := &models.FileMetadata{}
+	if takenAt, err := x.DateTime(); err == nil {
+		meta.TakenAt = &takenAt
+	}
+	camera := []string{}
+	for _, name := range []exif.FieldName{exif.Make, exif.Model} {
+		if tag, err := x.Get(name); err == nil {
+			if value, err := tag.StringVal(); err == nil && strings.TrimSpace(value) != "" {
+				camera = append(camera, strings.TrimSpace(value))
+			}
+		}
+	}
+	// Models usually repeat the make, "Canon Canon EOS R5"
+	if len(camera) == 2 && strings.HasPrefix(strings.ToLower(camera[1]), strings.ToLower(camera[0])) {
+		camera = camera[1:]
+	}
+	meta.Camera = truncateMetadata(strings.Join(camera, " "))
+	if lat, long, err := x.LatLong(); err == nil {
+		meta.Latitude, meta.Longitude = &lat, &long
+	}
+	return meta, nil
+}
+
+// pngMetadata reads the EXIF of the eXIf chunk of a PNG
+func pngMetadata(r io.Reader) (*models.FileMetadata, error) {
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return nil, err
+	}
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, nil
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:]) {
+		case "eXIf":
+			if length > maxEXIFChunk {
+				break
+			}
+			chunk := make([]byte, length)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return nil, err
+			}
+			return exifMetadata(bytes.NewReader(chunk))
+		case "IEND":
+			return nil, nil
+		}
+		// Skip the data and the CRC
+		if _, err := io.CopyN(io.Discard, r, length+4); err != nil {
+			return nil, nil
+		}
+	}
+}
+
+func pdfMetadata(r io.ReadSeeker) (*models.FileMetadata, error) {
+	info, err := api.PDFInfo(r, "", nil, pdfConfiguration())
+	if err != nil {
+		return nil, err
+	}
+	meta := &models.FileMetadata{
+		Author: truncateMetadata(info.Author),
+		Title:  truncateMetadata(info.Title),
+		Pages:  info.PageCount,
+	}
+	if createdAt, ok := types.DateTime(info.CreationDate, true); ok {
+		meta.TakenAt = &createdAt
+	}
+	return meta, nil
+}
+
+// Keep pdfcpu from creating its config directory in the user's home. Set
+// once, before any worker or handler reads it.
+func init() {
+	model.ConfigPath = "disable"
+}
+
+// pdfConfiguration is the default pdfcpu configuration
+func pdfConfiguration() *model.Configuration {
+	conf := model.NewDefaultConfiguration()
+	conf.ValidationMode = model.ValidationRelaxed
+	return conf
+}
+
+func truncateMetadata(value string) string {
+	value = strings.TrimSpace(value)
+	if runes := []rune(value); len(runes) > maxMetadataText {
+		return string(runes[:maxMetadataText])
+	}
+	return value
+}
+
+// DescribeMetadata writes the metadata for a prompt, leaving out the fields
+// the user opted out of
+func DescribeMetadata(meta *models.FileMetadata, optOut []string) string {
+	if meta == nil {
+		return ""
+	}
+	excluded := map[string]bool{}
+	for _, field := range optOut {
+		excluded[field] = true
+	}
+
+	details := []string{}
+	if meta.TakenAt != nil && !excluded[MetadataTakenAt] {
+		verb := "taken"
+		if meta.Pages > 0 {
+			verb = "created"
+		}
+		details = append(details, verb+" "+meta.TakenAt.Format("Monday, 2 January 2006 15:04"))
+	}
+	if meta.Camera != "" && !excluded[MetadataCamera] {
+		details = append(details, "camera "+meta.Camera)
+	}
+	if meta.Latitude != nil && meta.Longitude != nil && !excluded[MetadataLocation] {
+		details = append(details, fmt.Sprintf("GPS %.5f, %.5f", *meta.Latitude, *meta.Longitude))
+	}
+	if meta.Author != "" && !excluded[MetadataAuthor] {
+		details = append(details, fmt.Sprintf("author %q", meta.Author))
+	}
+	if meta.Title != "" && !excluded[MetadataTitle] {
+		details = append(details, fmt.Sprintf("title %q", meta.Title))
+	}
+	return strings.Join(details, ", ")
+}
+
+// ValidateMetadataFields checks that every field is one of MetadataFields
+func ValidateMetadataFields(fields []string) error {
+	for _, field := range fields {
+		known := false
+		for _, f := range MetadataFields {
+			known = known || f == field
+		}
+		if !known {
+			return fmt.Errorf("%w: %q", ErrInvalidMetadataField, field)
+		}
+	}
+	return nil
+}
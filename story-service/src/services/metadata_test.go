@@ -0,0 +1,154 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+// tiffEXIF returns a big-endian TIFF holding the Make and DateTime tags
+func tiffEXIF(camera, dateTime string) []byte {
+	var b bytes.Buffer
+	b.WriteString("MM\x00\x2a")
+	binary.Write(&b, binary.BigEndian, uint32(8))
+
+	values := []struct {
+		tag   uint16
+		value string
+	}{{0x010F, camera + "\x00"}, {0x0132, dateTime + "\x00"}}
+	// The values follow the IFD of two entries and the next IFD offset
+	offset := uint32(8 + 2 + len(values)*12 + 4)
+	binary.Write(&b, binary.BigEndian, uint16(len(values)))
+	for _, v := range values {
+		binary.Write(&b, binary.BigEndian, v.tag)
+		binary.Write(&b, binary.BigEndian, uint16(2))
+		binary.Write(&b, binary.BigEndian, uint32(len(v.value)))
+		binary.Write(&b, binary.BigEndian, offset)
+		offset += uint32(len(v.value))
+	}
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	for _, v := range values {
+		b.WriteString(v.value)
+	}
+	return b.Bytes()
+}
+
+// pngFile returns a PNG signature followed by the chunks, with a zero CRC
+func pngFile(chunks ...[]string) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	for _, chunk := range chunks {
+		binary.Write(&b, binary.BigEndian, uint32(len(chunk[1])))
+		b.WriteString(chunk[0])
+		b.WriteString(chunk[1])
+		b.Write(make([]byte, 4))
+	}
+	return b.Bytes()
+}
+
+func TestPNGMetadata(t *testing.T) {
+	exifChunk := []string{"eXIf", string(tiffEXIF("Canon", "2024:07:01 08:30:00"))}
+	header := []string{"IHDR", string(make([]byte, 13))}
+	end := []string{"IEND", ""}
+	takenAt := time.Date(2024, 7, 1, 8, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantCamera string
+		wantTaken  *time.Time
+		wantNil    bool
+		wantErr    bool
+	}{
+		{name: "exif chunk", data: pngFile(header, exifChunk, end), wantCamera: "Canon", wantTaken: &takenAt},
+		{name: "no exif chunk", data: pngFile(header, end), wantNil: true},
+		{name: "exif after the end", data: pngFile(header, end, exifChunk), wantNil: true},
+		{name: "chunk too large is skipped", data: pngFile(header, []string{"eXIf", string(make([]byte, maxEXIFChunk+1))}, end), wantNil: true},
+		{name: "truncated chunk list", data: pngFile(header)[:20], wantNil: true},
+		{name: "truncated exif chunk", data: pngFile(header, exifChunk)[:45], wantErr: true},
+		{name: "too short for a signature", data: []byte("\x89PN"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := pngMetadata(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr || tt.wantNil {
+				if meta != nil {
+					t.Errorf("metadata = %+v, want nil", meta)
+				}
+				return
+			}
+			if meta == nil {
+				t.Fatal("metadata is nil")
+			}
+			if meta.Camera != tt.wantCamera {
+				t.Errorf("camera = %q, want %q", meta.Camera, tt.wantCamera)
+			}
+			if meta.TakenAt == nil || !meta.TakenAt.Equal(*tt.wantTaken) {
+				t.Errorf("taken at = %v, want %v", meta.TakenAt, tt.wantTaken)
+			}
+		})
+	}
+}
+
+func TestDescribeMetadata(t *testing.T) {
+	takenAt := time.Date(2024, 7, 1, 8, 30, 0, 0, time.UTC)
+	latitude, longitude := 48.858370, 2.294481
+	photo := &models.FileMetadata{TakenAt: &takenAt, Camera: "Canon EOS R5", Latitude: &latitude, Longitude: &longitude}
+	pdf := &models.FileMetadata{TakenAt: &takenAt, Author: "Ann", Title: `The "Trip"`, Pages: 3}
+
+	tests := []struct {
+		name   string
+		meta   *models.FileMetadata
+		optOut []string
+		want   string
+	}{
+		{name: "no metadata", meta: nil, want: ""},
+		{name: "empty metadata", meta: &models.FileMetadata{}, want: ""},
+		{
+			name: "photo",
+			meta: photo,
+			want: "taken Monday, 1 July 2024 08:30, camera Canon EOS R5, GPS 48.85837, 2.29448",
+		},
+		{
+			name:   "photo without location",
+			meta:   photo,
+			optOut: []string{MetadataLocation},
+			want:   "taken Monday, 1 July 2024 08:30, camera Canon EOS R5",
+		},
+		{
+			name:   "photo with every field kept out",
+			meta:   photo,
+			optOut: MetadataFields,
+			want:   "",
+		},
+		{
+			name: "latitude without longitude",
+			meta: &models.FileMetadata{Latitude: &latitude},
+			want: "",
+		},
+		{
+			name: "document",
+			meta: pdf,
+			want: `created Monday, 1 July 2024 08:30, author "Ann", title "The \"Trip\""`,
+		},
+		{
+			name:   "document without author and date",
+			meta:   pdf,
+			optOut: []string{MetadataAuthor, MetadataTakenAt},
+			want:   `title "The \"Trip\""`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DescribeMetadata(tt.meta, tt.optOut); got != tt.want {
+				t.Errorf("DescribeMetadata() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,421 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+	defaultOpenAIModel   = "gpt-4o-mini"
+
+	defaultOpenAIContextWindow = 128000
+)
+
+// openaiGenerator talks to any server implementing the OpenAI chat completions API.
+type openaiGenerator struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+func newOpenAIGenerator() (*openaiGenerator, error) {
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	model := os.Getenv("OPENAI_MODEL")
+	if model == "" {
+		model = defaultOpenAIModel
+	}
+	return &openaiGenerator{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  os.Getenv("OPENAI_API_KEY"),
+		model:   model,
+		client:  &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+type openaiMessage struct {
+	Role    string              `json:"role"`
+	Content []openaiContentPart `json:"content"`
+}
+
+type openaiContentPart struct {
+	Type       string            `json:"type"`
+	Text       string            `json:"text,omitempty"`
+	ImageURL   *openaiImageURL   `json:"image_url,omitempty"`
+	File       *openaiFile       `json:"file,omitempty"`
+	InputAudio *openaiInputAudio `json:"input_audio,omitempty"`
+}
+
+type openaiImageURL struct {
+	URL string `json:"url"`
+}
+
+type openaiFile struct {
+	Filename string `json:"filename"`
+	FileData string `json:"file_data"`
+}
+
+type openaiInputAudio struct {
+	Data   string `json:"data"`
+	Format string `json:"format"`
+}
+
+// openaiAudioFormats maps the audio types the API reads to their format
+var openaiAudioFormats = map[string]string{
+	"audio/mpeg": "mp3",
+	"audio/wav":  "wav",
+}
+
+type openaiRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openaiMessage `json:"messages"`
+	Temperature *float32        `json:"temperature,omitempty"`
+	TopP        *float32        `json:"top_p,omitempty"`
+	MaxTokens   *int32          `json:"max_tokens,omitempty"`
+	Stop        []string        `json:"stop,omitempty"`
+	Stream      bool            `json:"stream,omitempty"`
+	// StreamOptions asks for the usage in the last chunk of a stream
+	StreamOptions *openaiStreamOptions `json:"stream_options,omitempty"`
+}
+
+type openaiStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openaiUsage struct {
+	PromptTokens     int32 `json:"prompt_tokens"`
+	CompletionTokens int32 `json:"completion_tokens"`
+	TotalTokens      int32 `json:"total_tokens"`
+}
+
+func (u *openaiUsage) toUsageMetadata() *genai.UsageMetadata {
+	if u == nil {
+		return nil
+	}
+	return &genai.UsageMetadata{
+		PromptTokenCount:     u.PromptTokens,
+		CandidatesTokenCount: u.CompletionTokens,
+		TotalTokenCount:      u.TotalTokens,
+	}
+}
+
+type openaiResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openaiUsage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type openaiStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *openaiUsage `json:"usage"`
+}
+
+func (g *openaiGenerator) Name() string {
+	return g.model
+}
+
+func (g *openaiGenerator) GenerateContent(
+	ctx context.Context,
+	config genai.GenerationConfig,
+	parts ...genai.Part,
+) (*genai.GenerateContentResponse, error) {
+	return g.complete(ctx, config, []*genai.Content{{Role: "user", Parts: parts}})
+}
+
+func (g *openaiGenerator) ContextWindow() int {
+	return defaultOpenAIContextWindow
+}
+
+// SupportsMediaType is true for images, PDFs and the audio formats of
+// openaiAudioFormats, the API has no video input
+func (g *openaiGenerator) SupportsMediaType(mimeType string) bool {
+	_, audio := openaiAudioFormats[mimeType]
+	return audio || mimeType == "application/pdf" || strings.HasPrefix(mimeType, "image/")
+}
+
+// CountTokens is not part of the chat completions API
+func (g *openaiGenerator) CountTokens(ctx context.Context, contents []*genai.Content) (int, error) {
+	return 0, errCountTokensUnsupported
+}
+
+func (g *openaiGenerator) StartChat(history []*genai.Content) ChatSession {
+	return &contentChat{
+		history: history,
+		generate: func(ctx context.Context, contents []*genai.Content) (*genai.GenerateContentResponse, error) {
+			return g.complete(ctx, genai.GenerationConfig{}, contents)
+		},
+		stream: func(ctx context.Context, contents []*genai.Content) ResponseIterator {
+			return g.completeStream(ctx, genai.GenerationConfig{}, contents)
+		},
+	}
+}
+
+func (g *openaiGenerator) newRequest(
+	ctx context.Context,
+	config genai.GenerationConfig,
+	contents []*genai.Content,
+	stream bool,
+) (*http.Request, error) {
+	messages, err := toOpenAIMessages(contents)
+	if err != nil {
+		return nil, err
+	}
+	request := openaiRequest{
+		Model:       g.model,
+		Messages:    messages,
+		Temperature: config.Temperature,
+		TopP:        config.TopP,
+		MaxTokens:   config.MaxOutputTokens,
+		Stop:        config.StopSequences,
+		Stream:      stream,
+	}
+	if stream {
+		request.StreamOptions = &openaiStreamOptions{IncludeUsage: true}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+	return req, nil
+}
+
+func (g *openaiGenerator) complete(
+	ctx context.Context,
+	config genai.GenerationConfig,
+	contents []*genai.Content,
+) (*genai.GenerateContentResponse, error) {
+	req, err := g.newRequest(ctx, config, contents, false)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, openaiStatusError(res)
+	}
+
+	var r openaiResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("could not decode openai response: %w", err)
+	}
+	if r.Error != nil {
+		return nil, fmt.Errorf("openai error: %s", r.Error.Message)
+	}
+
+	resp := &genai.GenerateContentResponse{UsageMetadata: r.Usage.toUsageMetadata()}
+	for i, choice := range r.Choices {
+		resp.Candidates = append(resp.Candidates, &genai.Candidate{
+			Index: int32(i),
+			Content: &genai.Content{
+				Role:  "model",
+				Parts: []genai.Part{genai.Text(choice.Message.Content)},
+			},
+			FinishReason: openaiFinishReason(choice.FinishReason),
+		})
+	}
+	return resp, nil
+}
+
+// completeStream sends a streaming request and reads the server-sent events
+// of the response as they arrive.
+func (g *openaiGenerator) completeStream(
+	ctx context.Context,
+	config genai.GenerationConfig,
+	contents []*genai.Content,
+) ResponseIterator {
+	req, err := g.newRequest(ctx, config, contents, true)
+	if err != nil {
+		return &sliceIterator{err: err}
+	}
+
+	res, err := g.client.Do(req)
+	if err != nil {
+		return &sliceIterator{err: err}
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return &sliceIterator{err: openaiStatusError(res)}
+	}
+	return &openaiStreamIterator{res: res, scanner: bufio.NewScanner(res.Body)}
+}
+
+// openaiAPIError is a response of the API with an error status
+type openaiAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *openaiAPIError) Error() string {
+	if e.Message != "" {
+		return "openai error: " + e.Message
+	}
+	return fmt.Sprintf("openai request failed with status %d", e.StatusCode)
+}
+
+// openaiStatusError describes a failed response, with the API's message
+// when the body is a JSON error rather than a proxy's error page
+func openaiStatusError(res *http.Response) error {
+	apiErr := &openaiAPIError{StatusCode: res.StatusCode}
+	var r openaiResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err == nil && r.Error != nil {
+		apiErr.Message = r.Error.Message
+	}
+	return apiErr
+}
+
+type openaiStreamIterator struct {
+	res     *http.Response
+	scanner *bufio.Scanner
+	err     error
+}
+
+func (it *openaiStreamIterator) Next() (*genai.GenerateContentResponse, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	for it.scanner.Scan() {
+		line := strings.TrimSpace(it.scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openaiStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, it.fail(fmt.Errorf("could not decode openai stream chunk: %w", err))
+		}
+		resp := &genai.GenerateContentResponse{UsageMetadata: chunk.Usage.toUsageMetadata()}
+		for i, choice := range chunk.Choices {
+			resp.Candidates = append(resp.Candidates, &genai.Candidate{
+				Index: int32(i),
+				Content: &genai.Content{
+					Role:  "model",
+					Parts: []genai.Part{genai.Text(choice.Delta.Content)},
+				},
+				FinishReason: openaiFinishReason(choice.FinishReason),
+			})
+		}
+		return resp, nil
+	}
+	if err := it.scanner.Err(); err != nil {
+		return nil, it.fail(err)
+	}
+	return nil, it.fail(iterator.Done)
+}
+
+func (it *openaiStreamIterator) fail(err error) error {
+	it.err = err
+	it.res.Body.Close()
+	return err
+}
+
+// Close ends the stream, Next then returns iterator.Done
+func (it *openaiStreamIterator) Close() error {
+	if it.err != nil {
+		return nil
+	}
+	it.err = iterator.Done
+	return it.res.Body.Close()
+}
+
+func toOpenAIMessages(contents []*genai.Content) ([]openaiMessage, error) {
+	messages := make([]openaiMessage, 0, len(contents))
+	for _, content := range contents {
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+		message := openaiMessage{Role: role}
+		for _, part := range content.Parts {
+			switch p := part.(type) {
+			case genai.Text:
+				message.Content = append(message.Content, openaiContentPart{Type: "text", Text: string(p)})
+			case genai.Blob:
+				blobPart, err := toOpenAIBlobPart(p)
+				if err != nil {
+					return nil, err
+				}
+				message.Content = append(message.Content, blobPart)
+			default:
+				return nil, fmt.Errorf("openai backend does not support %T parts", part)
+			}
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// toOpenAIBlobPart sends images as data URLs, PDFs as files and audio as
+// input audio
+func toOpenAIBlobPart(blob genai.Blob) (openaiContentPart, error) {
+	data := base64.StdEncoding.EncodeToString(blob.Data)
+	if format, ok := openaiAudioFormats[blob.MIMEType]; ok {
+		return openaiContentPart{Type: "input_audio", InputAudio: &openaiInputAudio{Data: data, Format: format}}, nil
+	}
+	url := "data:" + blob.MIMEType + ";base64," + data
+	switch {
+	case strings.HasPrefix(blob.MIMEType, "image/"):
+		return openaiContentPart{Type: "image_url", ImageURL: &openaiImageURL{URL: url}}, nil
+	case blob.MIMEType == "application/pdf":
+		return openaiContentPart{Type: "file", File: &openaiFile{Filename: "file.pdf", FileData: url}}, nil
+	}
+	return openaiContentPart{}, fmt.Errorf("%w: openai backend does not support %s content", ErrUnsupportedMediaType, blob.MIMEType)
+}
+
+func openaiFinishReason(reason string) genai.FinishReason {
+	switch reason {
+	case "stop":
+		return genai.FinishReasonStop
+	case "length":
+		return genai.FinishReasonMaxTokens
+	case "content_filter":
+		return genai.FinishReasonSafety
+	case "":
+		return genai.FinishReasonUnspecified
+	default:
+		return genai.FinishReasonOther
+	}
+}
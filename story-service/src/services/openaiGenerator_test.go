@@ -0,0 +1,38 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+func TestToOpenAIBlobPart(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		wantType string
+		wantErr  error
+	}{
+		{mimeType: "image/png", wantType: "image_url"},
+		{mimeType: "application/pdf", wantType: "file"},
+		{mimeType: "audio/mpeg", wantType: "input_audio"},
+		{mimeType: "audio/wav", wantType: "input_audio"},
+		{mimeType: "audio/ogg", wantErr: ErrUnsupportedMediaType},
+		{mimeType: "video/mp4", wantErr: ErrUnsupportedMediaType},
+	}
+	g := &openaiGenerator{}
+	for _, tt := range tests {
+		t.Run(tt.mimeType, func(t *testing.T) {
+			part, err := toOpenAIBlobPart(genai.Blob{MIMEType: tt.mimeType, Data: []byte("data")})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if part.Type != tt.wantType {
+				t.Errorf("type = %q, want %q", part.Type, tt.wantType)
+			}
+			if got := g.SupportsMediaType(tt.mimeType); got != (tt.wantErr == nil) {
+				t.Errorf("SupportsMediaType() = %v, want %v", got, tt.wantErr == nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+const (
+	defaultPDFChunkPages = 20
+	// pdfChunkMinPages is the length from which a PDF is read in parts
+	pdfChunkMinPages = 30
+	// pdfChunkConcurrency bounds the parts read at the same time
+	pdfChunkConcurrency = 3
+
+	chunkNotesPrompt = "These are pages %d to %d of a %d page document. " +
+		"Write detailed notes on what they contain: facts, names, numbers, events and conclusions. " +
+		"After each point cite the page it comes from as \"p. N\", numbering pages in the whole document, " +
+		"so the first page of this part is p. %d."
+	chunkedStoryPrompt = "The document is %d pages long and was read in parts. " +
+		"The notes of each part follow, with page references. " +
+		"Base your answer on them and cite pages as \"p. N\" where it helps the reader."
+)
+
+// ErrPDFTooLong rejects a long PDF attached to a session. Only uploads read
+// long PDFs in parts, attached whole it would go into every chat turn.
+var ErrPDFTooLong = errors.New("pdf is too long to attach, upload it to the session instead")
+
+// pdfChunk is a page range of a long PDF and the notes taken on it
+type pdfChunk struct {
+	from, thru int
+	pages      int
+	data       []byte
+	notes      string
+}
+
+// pdfChunkPages is the number of pages of a part, PDF_CHUNK_PAGES overrides it
+func pdfChunkPages() int {
+	if n, err := strconv.Atoi(os.Getenv("PDF_CHUNK_PAGES")); err == nil && n > 0 {
+		return n
+	}
+	return defaultPDFChunkPages
+}
+
+// splitLongPDF splits a PDF of at least pdfChunkMinPages pages into page
+// ranges. Other files give nil.
+func splitLongPDF(data []byte, mimeType string) ([]*pdfChunk, error) {
+	if mimeType != "application/pdf" {
+		return nil, nil
+	}
+	pages, err := api.PageCount(bytes.NewReader(data), pdfConfiguration())
+	if err != nil {
+		return nil, fmt.Errorf("could not read pdf: %w", err)
+	}
+	if pages < pdfChunkMinPages {
+		return nil, nil
+	}
+
+	spans, err := api.SplitRaw(bytes.NewReader(data), pdfChunkPages(), pdfConfiguration())
+	if err != nil {
+		return nil, fmt.Errorf("could not split pdf: %w", err)
+	}
+	chunks := make([]*pdfChunk, 0, len(spans))
+	for _, span := range spans {
+		part, err := io.ReadAll(span.Reader)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, &pdfChunk{from: span.From, thru: span.Thru, pages: pages, data: part})
+	}
+	return chunks, nil
+}
+
+// CheckAttachablePDF returns ErrPDFTooLong for a PDF that would be read in
+// parts. Other files pass.
+func CheckAttachablePDF(file *multipart.FileHeader, mimeType string) error {
+	if mimeType != "application/pdf" {
+		return nil
+	}
+	f, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pages, err := api.PageCount(f, pdfConfiguration())
+	if err != nil {
+		return fmt.Errorf("could not read pdf: %w", err)
+	}
+	if pages >= pdfChunkMinPages {
+		return fmt.Errorf("%w: it has %d pages", ErrPDFTooLong, pages)
+	}
+	return nil
+}
+
+// generateChunkedContent takes notes on each part of a long PDF, then writes
+// the story from the notes. The notes are kept with the file so the chat can
+// use them in place of the whole document.
+func generateChunkedContent(
+	ctx context.Context,
+	job *uploadJob,
+	chunks []*pdfChunk,
+	prompt *StoryPrompt,
+) (*genai.GenerateContentResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		done     int
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	setJobProgress(job, 0, len(chunks)+1)
+	sem := make(chan struct{}, pdfChunkConcurrency)
+	for _, chunk := range chunks {
+		wg.Add(1)
+		go func(chunk *pdfChunk) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := takeChunkNotes(ctx, job, chunk)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("pages %d-%d: %w", chunk.from, chunk.thru, err)
+					cancel()
+				}
+				return
+			}
+			done++
+			setJobProgress(job, done, len(chunks)+1)
+		}(chunk)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	notes := joinChunkNotes(chunks)
+	if err := savePageNotes(job.userID, job.fileIDs[0], notes); err != nil {
+		return nil, err
+	}
+
+	text := prompt.Text + "\n\n" + fmt.Sprintf(chunkedStoryPrompt, chunks[0].pages) + "\n\n" + notes
+	resp, err := Generator.GenerateContent(ctx, prompt.Config, genai.Text(text))
+	if err == nil {
+		setJobProgress(job, len(chunks)+1, len(chunks)+1)
+	}
+	return resp, err
+}
+
+func takeChunkNotes(ctx context.Context, job *uploadJob, chunk *pdfChunk) error {
+	config := genai.GenerationConfig{}
+	config.SetTemperature(0.2)
+	resp, err := Generator.GenerateContent(ctx, config,
+		genai.Text(fmt.Sprintf(chunkNotesPrompt, chunk.from, chunk.thru, chunk.pages, chunk.from)),
+		genai.Blob{MIMEType: "application/pdf", Data: chunk.data},
+	)
+	if resp != nil {
+		RecordUsage(job.userID, job.SessionID, UsageChunk, resp.UsageMetadata)
+	}
+	if err != nil {
+		return err
+	}
+	chunk.notes, err = ParseContentResponse(resp)
+	return err
+}
+
+func joinChunkNotes(chunks []*pdfChunk) string {
+	var b strings.Builder
+	for i, chunk := range chunks {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "Notes on pages %d-%d:\n%s", chunk.from, chunk.thru, strings.TrimSpace(chunk.notes))
+	}
+	return b.String()
+}
+
+func savePageNotes(userID string, fileID int64, notes string) error {
+	stmt := "UPDATE session_files SET page_notes = $1 WHERE user_id = $2 AND id = $3"
+	_, err := models.Db.Exec(stmt, notes, userID, fileID)
+	return err
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	pdfFontFamily = "story"
+	pdfLineHeight = 6
+	pdfIndent     = 6
+)
+
+// ErrPDFUnsupportedText rejects a PDF export of text the built-in fonts do
+// not cover
+var ErrPDFUnsupportedText = errors.New("the session has text the built-in PDF fonts cannot show")
+
+// pdfWriter lays out the document on A4 pages. The core fonts only cover
+// Western European text, PDF_FONT_FILE names a TrueType font for other
+// scripts.
+type pdfWriter struct {
+	pdf       *fpdf.Fpdf
+	family    string
+	translate func(string) string
+	images    int
+}
+
+func newPDFWriter() (*pdfWriter, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(20, 20, 20)
+	pdf.SetAutoPageBreak(true, 20)
+	w := &pdfWriter{pdf: pdf, family: "Helvetica", translate: pdf.UnicodeTranslatorFromDescriptor("")}
+
+	if path := os.Getenv("PDF_FONT_FILE"); path != "" {
+		font, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read PDF_FONT_FILE: %w", err)
+		}
+		for _, style := range []string{"", "B", "I"} {
+			pdf.AddUTF8FontFromBytes(pdfFontFamily, style, font)
+		}
+		w.family = pdfFontFamily
+		w.translate = func(s string) string { return s }
+	}
+	return w, pdf.Error()
+}
+
+// checkCoreFontText returns ErrPDFUnsupportedText when the document has
+// characters the core fonts cannot show, which would come out garbled
+func checkCoreFontText(doc *exportDocument) error {
+	encoder := charmap.Windows1252.NewEncoder()
+	texts := []string{doc.title}
+	if doc.cover != nil {
+		texts = append(texts, doc.cover.name)
+	}
+	for _, block := range doc.blocks {
+		if block.image != nil {
+			texts = append(texts, block.image.name)
+		}
+		texts = append(texts, block.text)
+	}
+	for _, s := range texts {
+		if _, err := encoder.String(s); err != nil {
+			return fmt.Errorf("%w, set PDF_FONT_FILE to a TrueType font that covers it", ErrPDFUnsupportedText)
+		}
+	}
+	return nil
+}
+
+func renderPDF(doc *exportDocument) ([]byte, error) {
+	w, err := newPDFWriter()
+	if err != nil {
+		return nil, err
+	}
+	if w.family != pdfFontFamily {
+		if err := checkCoreFontText(doc); err != nil {
+			return nil, err
+		}
+	}
+	pdf := w.pdf
+	pdf.SetTitle(doc.title, true)
+	pdf.AddPage()
+
+	w.paragraph(doc.title, "B", 20, 0, "C")
+	pdf.Ln(pdfLineHeight)
+	if doc.cover != nil {
+		w.image(doc.cover)
+		pdf.AddPage()
+	}
+
+	headings := doc.hasUserTurns()
+	for _, block := range doc.blocks {
+		if block.image != nil {
+			w.image(block.image)
+			continue
+		}
+		if headings {
+			w.paragraph(turnHeading(block.sender), "B", 13, 0, "L")
+		}
+		if block.sender == "user" {
+			w.paragraph(block.text, "I", 11, pdfIndent, "L")
+		} else {
+			source := []byte(block.text)
+			w.markdown(goldmark.DefaultParser().Parse(text.NewReader(source)), source, 0)
+		}
+		pdf.Ln(pdfLineHeight / 2)
+	}
+
+	var out bytes.Buffer
+	if err := pdf.Output(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// paragraph writes text wrapped to the page width, indented by indent
+func (w *pdfWriter) paragraph(s, style string, size, indent float64, align string) {
+	left, _, right, _ := w.pdf.GetMargins()
+	width, _ := w.pdf.GetPageSize()
+	w.pdf.SetFont(w.family, style, size)
+	w.pdf.SetX(left + indent)
+	w.pdf.MultiCell(width-left-right-indent, size*0.5, w.translate(s), "", align, false)
+	w.pdf.Ln(1)
+}
+
+// image places a photo at the page width, or smaller when it is tall
+func (w *pdfWriter) image(img *exportImage) {
+	pdf := w.pdf
+	w.images++
+	name := fmt.Sprintf("image-%d", w.images)
+	imageType := "JPG"
+	if img.mimeType == "image/png" {
+		imageType = "PNG"
+	}
+	info := pdf.RegisterImageOptionsReader(name, fpdf.ImageOptions{ImageType: imageType}, bytes.NewReader(img.data))
+	if pdf.Err() || info == nil {
+		// A photo the PDF cannot hold is left out, not the whole story
+		pdf.ClearError()
+		w.paragraph("["+img.name+"]", "I", 10, 0, "C")
+		return
+	}
+
+	left, top, right, bottom := pdf.GetMargins()
+	pageWidth, pageHeight := pdf.GetPageSize()
+	width := pageWidth - left - right
+	height := width * info.Height() / info.Width()
+	if maxHeight := (pageHeight - top - bottom) * 0.7; height > maxHeight {
+		width, height = width*maxHeight/height, maxHeight
+	}
+	if pdf.GetY()+height > pageHeight-bottom {
+		pdf.AddPage()
+	}
+	pdf.ImageOptions(name, left+(pageWidth-left-right-width)/2, pdf.GetY(), width, height, true, fpdf.ImageOptions{}, 0, "")
+	w.paragraph(img.name, "I", 9, 0, "C")
+	pdf.Ln(pdfLineHeight / 2)
+}
+
+// markdown writes the blocks of a Markdown document. Inline emphasis and
+// links are kept as plain text.
+func (w *pdfWriter) markdown(node ast.Node, source []byte, indent float64) {
+	for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+		switch n := child.(type) {
+		case *ast.Heading:
+			w.paragraph(inlineText(n, source), "B", float64(18-2*min(n.Level, 4)), indent, "L")
+		case *ast.Paragraph, *ast.TextBlock:
+			w.paragraph(inlineText(n, source), "", 11, indent, "L")
+		case *ast.List:
+			number := n.Start
+			for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+				marker := "•"
+				if n.IsOrdered() {
+					marker = fmt.Sprintf("%d.", number)
+					number++
+				}
+				w.listItem(item, source, indent, marker)
+			}
+		case *ast.FencedCodeBlock, *ast.CodeBlock:
+			var code strings.Builder
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				segment := lines.At(i)
+				code.Write(segment.Value(source))
+			}
+			w.paragraph(strings.TrimRight(code.String(), "\n"), "", 10, indent+pdfIndent, "L")
+		case *ast.Blockquote:
+			w.markdown(n, source, indent+pdfIndent)
+		case *ast.ThematicBreak:
+			left, _, right, _ := w.pdf.GetMargins()
+			width, _ := w.pdf.GetPageSize()
+			y := w.pdf.GetY() + pdfLineHeight/2
+			w.pdf.Line(left+indent, y, width-right, y)
+			w.pdf.Ln(pdfLineHeight)
+		case *ast.HTMLBlock:
+			// Raw HTML is left out like in the HTML export
+		default:
+			w.markdown(n, source, indent)
+		}
+	}
+}
+
+// listItem writes the first block of an item after its marker and the
+// others, like nested lists, indented below it
+func (w *pdfWriter) listItem(item ast.Node, source []byte, indent float64, marker string) {
+	first := item.FirstChild()
+	if first == nil {
+		return
+	}
+	switch first.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		w.paragraph(marker+" "+inlineText(first, source), "", 11, indent+pdfIndent, "L")
+		rest := ast.NewDocument()
+		for child := first.NextSibling(); child != nil; {
+			next := child.NextSibling()
+			rest.AppendChild(rest, child)
+			child = next
+		}
+		w.markdown(rest, source, indent+2*pdfIndent)
+	default:
+		w.paragraph(marker, "", 11, indent+pdfIndent, "L")
+		w.markdown(item, source, indent+2*pdfIndent)
+	}
+}
+
+// inlineText returns the text of the inline nodes under node
+func inlineText(node ast.Node, source []byte) string {
+	var b strings.Builder
+	var walk func(ast.Node)
+	walk = func(n ast.Node) {
+		for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+			switch c := child.(type) {
+			case *ast.Text:
+				b.Write(c.Segment.Value(source))
+				if c.HardLineBreak() {
+					b.WriteString("\n")
+				} else if c.SoftLineBreak() {
+					b.WriteString(" ")
+				}
+			case *ast.String:
+				b.Write(c.Value)
+			case *ast.AutoLink:
+				b.Write(c.Label(source))
+			case *ast.RawHTML:
+			default:
+				walk(c)
+			}
+		}
+	}
+	walk(node)
+	return b.String()
+}
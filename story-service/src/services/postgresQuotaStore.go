@@ -0,0 +1,39 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+// postgresQuotaStore keeps the counters in the quota_counters table so they
+// are shared between instances
+type postgresQuotaStore struct{}
+
+func newPostgresQuotaStore() *postgresQuotaStore {
+	return &postgresQuotaStore{}
+}
+
+func (s *postgresQuotaStore) Add(ctx context.Context, key string, start time.Time, n int64) (int64, error) {
+	stmt := `INSERT INTO quota_counters(key, window_start, count) VALUES ($1, $2, GREATEST($3, 0))
+	ON CONFLICT (key) DO UPDATE SET
+		count = GREATEST(CASE WHEN quota_counters.window_start = EXCLUDED.window_start
+			THEN quota_counters.count + $3 ELSE $3 END, 0),
+		window_start = EXCLUDED.window_start
+	RETURNING count`
+	var count int64
+	err := models.Db.QueryRowContext(ctx, stmt, key, start, n).Scan(&count)
+	return count, err
+}
+
+func (s *postgresQuotaStore) Get(ctx context.Context, key string, start time.Time) (int64, error) {
+	stmt := `SELECT count FROM quota_counters WHERE key = $1 AND window_start = $2`
+	var count int64
+	err := models.Db.QueryRowContext(ctx, stmt, key, start).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
@@ -0,0 +1,30 @@
+package services
+
+import (
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+// GetMetadataOptOut returns the metadata fields the user keeps out of prompts
+func GetMetadataOptOut(userID string) ([]string, error) {
+	fields := []string{}
+	stmt := "SELECT metadata_opt_out FROM user_preferences WHERE user_id = $1"
+	err := models.Db.QueryRow(stmt, userID).Scan(pq.Array(&fields))
+	if err == sql.ErrNoRows {
+		return []string{}, nil
+	}
+	return fields, err
+}
+
+// SetMetadataOptOut replaces the metadata fields the user keeps out of prompts
+func SetMetadataOptOut(userID string, fields []string) error {
+	if err := ValidateMetadataFields(fields); err != nil {
+		return err
+	}
+	stmt := `INSERT INTO user_preferences(user_id, metadata_opt_out) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET metadata_opt_out = EXCLUDED.metadata_opt_out, updated_at = CURRENT_TIMESTAMP`
+	_, err := models.Db.Exec(stmt, userID, pq.Array(fields))
+	return err
+}
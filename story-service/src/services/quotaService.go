@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+const (
+	QuotaUploadsPerDay      = "uploads_per_day"
+	QuotaChatTurnsPerMinute = "chat_turns_per_minute"
+	QuotaTokensPerMonth     = "tokens_per_month"
+)
+
+// QuotaError tells which limit was reached and when it resets
+type QuotaError struct {
+	Limit      string
+	Max        int64
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s: %s limit of %d reached", ErrQuotaExceeded, e.Limit, e.Max)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// quotaLimit is a per-user limit over a fixed window. A max of 0 means no limit.
+type quotaLimit struct {
+	name   string
+	env    string
+	window func(now time.Time) (start, end time.Time)
+}
+
+var (
+	uploadsPerDay = quotaLimit{QuotaUploadsPerDay, "QUOTA_UPLOADS_PER_DAY", func(now time.Time) (time.Time, time.Time) {
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}}
+	chatTurnsPerMinute = quotaLimit{QuotaChatTurnsPerMinute, "QUOTA_CHAT_TURNS_PER_MINUTE", func(now time.Time) (time.Time, time.Time) {
+		start := now.Truncate(time.Minute)
+		return start, start.Add(time.Minute)
+	}}
+	tokensPerMonth = quotaLimit{QuotaTokensPerMonth, "QUOTA_TOKENS_PER_MONTH", func(now time.Time) (time.Time, time.Time) {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}}
+)
+
+func (l quotaLimit) max() int64 {
+	max, err := strconv.ParseInt(os.Getenv(l.env), 10, 64)
+	if err != nil || max < 0 {
+		return 0
+	}
+	return max
+}
+
+func (l quotaLimit) key(userID string) string {
+	return userID + ":" + l.name
+}
+
+// check returns a QuotaError when the user has already used up the limit
+func (l quotaLimit) check(ctx context.Context, userID string) error {
+	max := l.max()
+	if max == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	start, end := l.window(now)
+	count, err := Quotas.Get(ctx, l.key(userID), start)
+	if err != nil {
+		return err
+	}
+	if count >= max {
+		return &QuotaError{Limit: l.name, Max: max, RetryAfter: end.Sub(now)}
+	}
+	return nil
+}
+
+// take counts one use of the limit and returns a QuotaError when it goes
+// over. Rejected uses are counted too, so retrying early does not help.
+func (l quotaLimit) take(ctx context.Context, userID string) error {
+	max := l.max()
+	if max == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	start, end := l.window(now)
+	count, err := Quotas.Add(ctx, l.key(userID), start, 1)
+	if err != nil {
+		return err
+	}
+	if count > max {
+		return &QuotaError{Limit: l.name, Max: max, RetryAfter: end.Sub(now)}
+	}
+	return nil
+}
+
+// reserve counts one use of the limit and returns a QuotaError when it goes
+// over, in which case the use is given back. Counting first makes concurrent
+// uses see each other.
+func (l quotaLimit) reserve(ctx context.Context, userID string) error {
+	max := l.max()
+	if max == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	start, end := l.window(now)
+	count, err := Quotas.Add(ctx, l.key(userID), start, 1)
+	if err != nil {
+		return err
+	}
+	if count > max {
+		if _, err := Quotas.Add(ctx, l.key(userID), start, -1); err != nil {
+			log.Printf("could not give back %s of user %s: %v", l.name, userID, err)
+		}
+		return &QuotaError{Limit: l.name, Max: max, RetryAfter: end.Sub(now)}
+	}
+	return nil
+}
+
+// count adds n uses of the limit made at the time at. Uses of a window that
+// is already over are left alone.
+func (l quotaLimit) count(ctx context.Context, userID string, at time.Time, n int64) error {
+	if l.max() == 0 {
+		return nil
+	}
+	start, _ := l.window(time.Now().UTC())
+	if atStart, _ := l.window(at.UTC()); !atStart.Equal(start) {
+		return nil
+	}
+	_, err := Quotas.Add(ctx, l.key(userID), start, n)
+	return err
+}
+
+// TakeUploadQuota reserves an upload of the user against the daily upload
+// limit, after checking the monthly token limit. An upload that is not
+// accepted is given back with RefundUpload.
+func TakeUploadQuota(ctx context.Context, userID string) error {
+	if err := tokensPerMonth.check(ctx, userID); err != nil {
+		return err
+	}
+	return uploadsPerDay.reserve(ctx, userID)
+}
+
+// RefundUpload gives back the upload reserved at uploadedAt, for an upload
+// that was rejected or whose story failed
+func RefundUpload(ctx context.Context, userID string, uploadedAt time.Time) {
+	if err := uploadsPerDay.count(ctx, userID, uploadedAt, -1); err != nil {
+		log.Printf("could not refund upload of user %s: %v", userID, err)
+	}
+}
+
+// TakeChatQuota counts a chat turn of the user against the per-minute turn
+// limit, after checking the monthly token limit
+func TakeChatQuota(ctx context.Context, userID string) error {
+	if err := tokensPerMonth.check(ctx, userID); err != nil {
+		return err
+	}
+	return chatTurnsPerMinute.take(ctx, userID)
+}
+
+// addTokenUsage counts tokens used by the user against the monthly limit
+func addTokenUsage(ctx context.Context, userID string, tokens int64) {
+	if tokensPerMonth.max() == 0 || tokens == 0 {
+		return
+	}
+	start, _ := tokensPerMonth.window(time.Now().UTC())
+	if _, err := Quotas.Add(ctx, tokensPerMonth.key(userID), start, tokens); err != nil {
+		log.Printf("could not count tokens of user %s: %v", userID, err)
+	}
+}
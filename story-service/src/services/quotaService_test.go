@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// awayFromWindowEdge waits out the last and first second of the current
+// window of the limit, so the uses of a test fall in one window
+func awayFromWindowEdge(l quotaLimit) {
+	now := time.Now().UTC()
+	start, end := l.window(now)
+	if end.Sub(now) < time.Second || now.Sub(start) < time.Second {
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// useMemoryQuotas counts quotas in a new memory store for the test
+func useMemoryQuotas(t *testing.T) {
+	t.Helper()
+	previous := Quotas
+	Quotas = newMemoryQuotaStore()
+	t.Cleanup(func() { Quotas = previous })
+}
+
+func TestQuotaWindows(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     quotaLimit
+		now       time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "day",
+			limit:     uploadsPerDay,
+			now:       time.Date(2024, 3, 10, 15, 4, 5, 6, time.UTC),
+			wantStart: time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "last day of the year",
+			limit:     uploadsPerDay,
+			now:       time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC),
+			wantStart: time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "minute",
+			limit:     chatTurnsPerMinute,
+			now:       time.Date(2024, 3, 10, 15, 4, 59, 999, time.UTC),
+			wantStart: time.Date(2024, 3, 10, 15, 4, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 10, 15, 5, 0, 0, time.UTC),
+		},
+		{
+			name:      "start of a minute",
+			limit:     chatTurnsPerMinute,
+			now:       time.Date(2024, 3, 10, 15, 5, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 3, 10, 15, 5, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 3, 10, 15, 6, 0, 0, time.UTC),
+		},
+		{
+			name:      "month",
+			limit:     tokensPerMonth,
+			now:       time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "december",
+			limit:     tokensPerMonth,
+			now:       time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC),
+			wantStart: time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.limit.window(tt.now)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("window(%v) = %v, %v, want %v, %v", tt.now, start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestQuotaLimitMax(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{value: "", want: 0},
+		{value: "5", want: 5},
+		{value: "-1", want: 0},
+		{value: "many", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv(uploadsPerDay.env, tt.value)
+			if got := uploadsPerDay.max(); got != tt.want {
+				t.Errorf("max() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	ctx := context.Background()
+	awayFromWindowEdge(uploadsPerDay)
+	now := time.Now()
+	tests := []struct {
+		name string
+		// steps take an upload ("take", "rejected" when it must fail) or
+		// refund one made now ("refund") or two days ago ("refund old")
+		steps []string
+	}{
+		{name: "up to the limit", steps: []string{"take", "take", "rejected"}},
+		{name: "rejected uploads are not counted", steps: []string{"take", "take", "rejected", "rejected", "refund", "take", "rejected"}},
+		{name: "refund frees an upload", steps: []string{"take", "take", "refund", "take", "rejected"}},
+		{name: "refund of an earlier window is ignored", steps: []string{"take", "take", "refund old", "rejected"}},
+		{name: "refunds do not go below zero", steps: []string{"refund", "refund", "take", "take", "rejected"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(uploadsPerDay.env, "2")
+			t.Setenv(tokensPerMonth.env, "")
+			useMemoryQuotas(t)
+
+			for i, step := range tt.steps {
+				switch step {
+				case "refund":
+					RefundUpload(ctx, "u1", now)
+				case "refund old":
+					RefundUpload(ctx, "u1", now.Add(-48*time.Hour))
+				default:
+					err := TakeUploadQuota(ctx, "u1")
+					if wantErr := step == "rejected"; (err != nil) != wantErr {
+						t.Fatalf("step %d: error = %v, want error %v", i+1, err, wantErr)
+					}
+					if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+						t.Errorf("step %d: error = %v, want %v", i+1, err, ErrQuotaExceeded)
+					}
+				}
+			}
+			if err := TakeUploadQuota(ctx, "u2"); err != nil {
+				t.Errorf("other user: %v", err)
+			}
+		})
+	}
+}
+
+func TestConcurrentUploadQuota(t *testing.T) {
+	t.Setenv(uploadsPerDay.env, "5")
+	t.Setenv(tokensPerMonth.env, "")
+	useMemoryQuotas(t)
+	awayFromWindowEdge(uploadsPerDay)
+
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if TakeUploadQuota(context.Background(), "u1") == nil {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := accepted.Load(); got != 5 {
+		t.Errorf("accepted %d concurrent uploads, want 5", got)
+	}
+}
+
+func TestChatQuota(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv(chatTurnsPerMinute.env, "2")
+	t.Setenv(tokensPerMonth.env, "")
+	useMemoryQuotas(t)
+	awayFromWindowEdge(chatTurnsPerMinute)
+
+	for i, wantErr := range []bool{false, false, true, true} {
+		err := TakeChatQuota(ctx, "u1")
+		if (err != nil) != wantErr {
+			t.Fatalf("turn %d: error = %v, want error %v", i+1, err, wantErr)
+		}
+		quotaErr := &QuotaError{}
+		if err != nil && (!errors.As(err, &quotaErr) || quotaErr.RetryAfter <= 0 || quotaErr.RetryAfter > time.Minute) {
+			t.Errorf("turn %d: error = %#v, want a retry within a minute", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	QuotaStoreMemory   = "memory"
+	QuotaStorePostgres = "postgres"
+)
+
+// QuotaStore keeps one counter per key for the current window of a limit
+type QuotaStore interface {
+	// Add adds n to the counter of key for the window starting at start and
+	// returns the new count. A counter of an older window starts again at
+	// zero, and a counter never goes below zero.
+	Add(ctx context.Context, key string, start time.Time, n int64) (int64, error)
+	// Get returns the counter of key for the window starting at start
+	Get(ctx context.Context, key string, start time.Time) (int64, error)
+}
+
+var Quotas QuotaStore
+
+// CreateQuotaStore creates the quota store selected by QUOTA_STORE.
+// It defaults to memory, which only works with a single instance.
+func CreateQuotaStore() error {
+	kind := os.Getenv("QUOTA_STORE")
+	if kind == "" {
+		kind = QuotaStoreMemory
+	}
+
+	switch kind {
+	case QuotaStoreMemory:
+		Quotas = newMemoryQuotaStore()
+	case QuotaStorePostgres:
+		Quotas = newPostgresQuotaStore()
+	default:
+		return fmt.Errorf("unknown QUOTA_STORE %q", kind)
+	}
+	log.Printf("using %s quota store", kind)
+	return nil
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+var (
+	ErrResponseBlocked    = errors.New("response blocked by safety filters")
+	ErrResponseRecitation = errors.New("response stopped for reciting protected content")
+	ErrResponseMaxTokens  = errors.New("response stopped at the maximum number of tokens")
+	ErrResponseEmpty      = errors.New("response has no text")
+)
+
+// GenerationError describes why a model response could not be used. It wraps
+// one of the ErrResponse errors so callers can match it with errors.Is.
+type GenerationError struct {
+	Err error
+	// Reason is the finish or block reason reported by the model
+	Reason string
+	// Categories are the harm categories that blocked the response
+	Categories []string
+	// Partial is the text produced before the model stopped
+	Partial string
+}
+
+func (e *GenerationError) Error() string {
+	msg := e.Err.Error()
+	if e.Reason != "" {
+		msg += " (" + e.Reason + ")"
+	}
+	if len(e.Categories) > 0 {
+		msg += ": " + strings.Join(e.Categories, ", ")
+	}
+	return msg
+}
+
+func (e *GenerationError) Unwrap() error {
+	return e.Err
+}
+
+// ResponseText joins the text parts of the first candidate. It does not check
+// why the model stopped, see ParseContentResponse.
+func ResponseText(r *genai.GenerateContentResponse) string {
+	if r == nil || len(r.Candidates) == 0 || r.Candidates[0] == nil || r.Candidates[0].Content == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, part := range r.Candidates[0].Content.Parts {
+		if text, ok := part.(genai.Text); ok {
+			b.WriteString(string(text))
+		}
+	}
+	return b.String()
+}
+
+// CheckResponse returns a GenerationError if the prompt was blocked or the
+// first candidate stopped for any reason other than finishing normally. It
+// accepts responses without candidates, like intermediate stream chunks.
+func CheckResponse(r *genai.GenerateContentResponse) error {
+	if r == nil {
+		return nil
+	}
+	if feedback := r.PromptFeedback; feedback != nil && feedback.BlockReason != genai.BlockedReasonUnspecified {
+		reason := feedback.BlockReason.String()
+		if feedback.BlockReasonMessage != "" {
+			reason = feedback.BlockReasonMessage
+		}
+		return &GenerationError{
+			Err:        ErrResponseBlocked,
+			Reason:     reason,
+			Categories: blockedCategories(feedback.SafetyRatings),
+		}
+	}
+	if len(r.Candidates) == 0 || r.Candidates[0] == nil {
+		return nil
+	}
+
+	candidate := r.Candidates[0]
+	var err error
+	switch candidate.FinishReason {
+	case genai.FinishReasonSafety, genai.FinishReasonBlocklist,
+		genai.FinishReasonProhibitedContent, genai.FinishReasonSpii:
+		err = ErrResponseBlocked
+	case genai.FinishReasonRecitation:
+		err = ErrResponseRecitation
+	case genai.FinishReasonMaxTokens:
+		err = ErrResponseMaxTokens
+	default:
+		return nil
+	}
+	return &GenerationError{
+		Err:        err,
+		Reason:     candidate.FinishReason.String(),
+		Categories: blockedCategories(candidate.SafetyRatings),
+		Partial:    ResponseText(r),
+	}
+}
+
+// ParseContentResponse returns the text of a complete model response, or a
+// GenerationError if there is no usable text
+func ParseContentResponse(r *genai.GenerateContentResponse) (string, error) {
+	if err := CheckResponse(r); err != nil {
+		return "", err
+	}
+	text := ResponseText(r)
+	if strings.TrimSpace(text) == "" {
+		return "", &GenerationError{Err: ErrResponseEmpty}
+	}
+	return text, nil
+}
+
+// ClassifyGenerationError turns the errors the genai client returns for
+// blocked responses into a GenerationError. Other errors are returned as is.
+func ClassifyGenerationError(err error) error {
+	blocked := &genai.BlockedError{}
+	if !errors.As(err, &blocked) {
+		return err
+	}
+	r := &genai.GenerateContentResponse{PromptFeedback: blocked.PromptFeedback}
+	if blocked.Candidate != nil {
+		r = &genai.GenerateContentResponse{Candidates: []*genai.Candidate{blocked.Candidate}}
+	}
+	if classified := CheckResponse(r); classified != nil {
+		return classified
+	}
+	return &GenerationError{Err: ErrResponseBlocked, Reason: err.Error()}
+}
+
+func blockedCategories(ratings []*genai.SafetyRating) []string {
+	categories := []string{}
+	for _, rating := range ratings {
+		if rating != nil && rating.Blocked {
+			categories = append(categories, fmt.Sprint(rating.Category))
+		}
+	}
+	return categories
+}
+
+// GenerationErrorCode maps a generation failure to the error code sent to clients
+func GenerationErrorCode(err error) models.ErrorCode {
+	switch {
+	case errors.Is(err, ErrResponseBlocked):
+		return models.ErrorCodeBlocked
+	case errors.Is(err, ErrResponseRecitation):
+		return models.ErrorCodeRecitation
+	case errors.Is(err, ErrResponseMaxTokens):
+		return models.ErrorCodeMaxTokens
+	case errors.Is(err, ErrResponseEmpty):
+		return models.ErrorCodeEmptyResponse
+	default:
+		return models.ErrorCodeGeneration
+	}
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// textResponse returns a response with one candidate holding the parts
+func textResponse(reason genai.FinishReason, parts ...genai.Part) *genai.GenerateContentResponse {
+	return &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{
+		Content:      &genai.Content{Role: "model", Parts: parts},
+		FinishReason: reason,
+	}}}
+}
+
+func TestCheckResponse(t *testing.T) {
+	blockedPrompt := &genai.GenerateContentResponse{PromptFeedback: &genai.PromptFeedback{
+		BlockReason:        genai.BlockedReasonSafety,
+		BlockReasonMessage: "unsafe prompt",
+		SafetyRatings: []*genai.SafetyRating{
+			{Category: genai.HarmCategoryHarassment, Blocked: true},
+			{Category: genai.HarmCategoryHateSpeech},
+		},
+	}}
+
+	tests := []struct {
+		name           string
+		response       *genai.GenerateContentResponse
+		wantErr        error
+		wantReason     string
+		wantCategories int
+		wantPartial    string
+	}{
+		{name: "nil response", response: nil},
+		{name: "chunk without candidates", response: &genai.GenerateContentResponse{}},
+		{name: "finished", response: textResponse(genai.FinishReasonStop, genai.Text("done"))},
+		{name: "still streaming", response: textResponse(genai.FinishReasonUnspecified, genai.Text("par"))},
+		{
+			name:           "blocked prompt",
+			response:       blockedPrompt,
+			wantErr:        ErrResponseBlocked,
+			wantReason:     "unsafe prompt",
+			wantCategories: 1,
+		},
+		{
+			name:       "safety stop",
+			response:   textResponse(genai.FinishReasonSafety, genai.Text("half a")),
+			wantErr:    ErrResponseBlocked,
+			wantReason: genai.FinishReasonSafety.String(),
+			// the text before the stop is kept
+			wantPartial: "half a",
+		},
+		{
+			name:       "recitation",
+			response:   textResponse(genai.FinishReasonRecitation),
+			wantErr:    ErrResponseRecitation,
+			wantReason: genai.FinishReasonRecitation.String(),
+		},
+		{
+			name:        "max tokens",
+			response:    textResponse(genai.FinishReasonMaxTokens, genai.Text("cut"), genai.Text(" off")),
+			wantErr:     ErrResponseMaxTokens,
+			wantReason:  genai.FinishReasonMaxTokens.String(),
+			wantPartial: "cut off",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckResponse(tt.response)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			genErr := &GenerationError{}
+			if !errors.As(err, &genErr) {
+				t.Fatalf("error %T is not a GenerationError", err)
+			}
+			if genErr.Reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", genErr.Reason, tt.wantReason)
+			}
+			if len(genErr.Categories) != tt.wantCategories {
+				t.Errorf("categories = %v, want %d", genErr.Categories, tt.wantCategories)
+			}
+			if genErr.Partial != tt.wantPartial {
+				t.Errorf("partial = %q, want %q", genErr.Partial, tt.wantPartial)
+			}
+		})
+	}
+}
+
+func TestParseContentResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response *genai.GenerateContentResponse
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "text parts are joined",
+			response: textResponse(genai.FinishReasonStop, genai.Text("Once "), genai.Text("upon a time")),
+			want:     "Once upon a time",
+		},
+		{
+			name:     "other parts are ignored",
+			response: textResponse(genai.FinishReasonStop, genai.Blob{MIMEType: "image/png"}, genai.Text("story")),
+			want:     "story",
+		},
+		{name: "no candidates", response: &genai.GenerateContentResponse{}, wantErr: ErrResponseEmpty},
+		{name: "blank text", response: textResponse(genai.FinishReasonStop, genai.Text(" \n ")), wantErr: ErrResponseEmpty},
+		{name: "candidate without content", response: &genai.GenerateContentResponse{Candidates: []*genai.Candidate{{}}}, wantErr: ErrResponseEmpty},
+		{name: "stopped early", response: textResponse(genai.FinishReasonMaxTokens, genai.Text("cut")), wantErr: ErrResponseMaxTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseContentResponse(tt.response)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+const sessionColumns = "id, user_id, title, file_id, created_at, updated_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// execer is a *sql.DB or a *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func scanSession(row rowScanner) (*models.Session, error) {
+	s := models.Session{}
+	var fileID sql.NullInt64
+	if err := row.Scan(&s.ID, &s.UserID, &s.Title, &fileID, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	if fileID.Valid {
+		s.FileID = &fileID.Int64
+	}
+	return &s, nil
+}
+
+// CreateSession creates a new session for the user
+func CreateSession(userID, title string) (*models.Session, error) {
+	stmt := "INSERT INTO sessions(user_id, title) VALUES ($1, $2) RETURNING " + sessionColumns
+	return scanSession(models.Db.QueryRow(stmt, userID, title))
+}
+
+// EnsureSession returns the session of the user an upload goes to. Without
+// an ID it creates a new session, the server picks session IDs so that no
+// user can take another's. It returns ErrSessionNotFound if the session
+// does not exist or belongs to another user.
+func EnsureSession(userID, sessionID, title string) (*models.Session, error) {
+	if sessionID == "" {
+		return CreateSession(userID, title)
+	}
+	return GetSession(userID, sessionID)
+}
+
+// GetSession returns a session owned by the user
+func GetSession(userID, sessionID string) (*models.Session, error) {
+	stmt := "SELECT " + sessionColumns + " FROM sessions WHERE user_id = $1 AND id = $2"
+	return scanSession(models.Db.QueryRow(stmt, userID, sessionID))
+}
+
+// ListSessions returns the sessions of the user, most recently updated first
+func ListSessions(userID string) ([]*models.Session, error) {
+	stmt := "SELECT " + sessionColumns + " FROM sessions WHERE user_id = $1 ORDER BY updated_at DESC"
+	rows, err := models.Db.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*models.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// UpdateSessionTitle renames a session owned by the user
+func UpdateSessionTitle(userID, sessionID, title string) (*models.Session, error) {
+	stmt := `UPDATE sessions SET title = $3, updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND id = $2 RETURNING ` + sessionColumns
+	return scanSession(models.Db.QueryRow(stmt, userID, sessionID, title))
+}
+
+// SetSessionFile links the session to its source file, the first one
+// uploaded to it
+func SetSessionFile(userID, sessionID string, fileID int64) error {
+	stmt := `UPDATE sessions SET file_id = COALESCE(file_id, $3), updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND id = $2`
+	_, err := models.Db.Exec(stmt, userID, sessionID, fileID)
+	return err
+}
+
+// deleteEmptySession deletes a session that has no files and no messages
+func deleteEmptySession(tx *sql.Tx, userID, sessionID string) error {
+	stmt := `DELETE FROM sessions WHERE user_id = $1 AND id = $2
+	AND NOT EXISTS (SELECT 1 FROM session_files WHERE user_id = $1 AND session_id = $2)
+	AND NOT EXISTS (SELECT 1 FROM chat_sessions WHERE user_id = $1 AND session_id = $2)`
+	_, err := tx.Exec(stmt, userID, sessionID)
+	return err
+}
+
+// TouchSession marks the session as updated now
+func TouchSession(userID, sessionID string) error {
+	return touchSession(models.Db, userID, sessionID)
+}
+
+func touchSession(db execer, userID, sessionID string) error {
+	stmt := "UPDATE sessions SET updated_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND id = $2"
+	_, err := db.Exec(stmt, userID, sessionID)
+	return err
+}
+
+// DeleteSession deletes a session owned by the user together with its
+// messages and files
+func DeleteSession(ctx context.Context, userID, sessionID string) error {
+	tx, err := models.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		"SELECT storage_key FROM session_files WHERE user_id = $1 AND session_id = $2 AND storage_key IS NOT NULL",
+		userID, sessionID,
+	)
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("DELETE FROM sessions WHERE user_id = $1 AND id = $2", userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrSessionNotFound
+	}
+
+	if _, err := tx.Exec("DELETE FROM chat_sessions WHERE user_id = $1 AND session_id = $2", userID, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM session_files WHERE user_id = $1 AND session_id = $2", userID, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM session_summaries WHERE user_id = $1 AND session_id = $2", userID, sessionID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM upload_jobs WHERE user_id = $1 AND session_id = $2", userID, sessionID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	cancelSessionJobs(sessionID)
+
+	// The rows are gone, a blob left behind here is only wasted space
+	for _, key := range keys {
+		if err := Blobs.Delete(ctx, key); err != nil {
+			log.Printf("could not delete blob %s: %v", key, err)
+		}
+	}
+	return nil
+}
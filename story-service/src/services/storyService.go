@@ -2,176 +2,465 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/vertexai/genai"
 	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
-	"google.golang.org/api/option"
 )
 
-const (
-	projectID = "analyzing-media-files-web-app"
-	location  = "asia-southeast1"
-	ModelName = "gemini-1.5-flash-001"
-)
+// GenerateContentFromData generates a story about the file's content
+func GenerateContentFromData(
+	c context.Context,
+	data []byte,
+	mimeType string,
+	prompt *StoryPrompt,
+) (*genai.GenerateContentResponse, error) {
+	parts, err := documentParts(data, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	return Generator.GenerateContent(c, prompt.Config, append([]genai.Part{genai.Text(prompt.Text)}, parts...)...)
+}
 
-var GenaiClient *genai.Client
+// SaveMessage save message to PostgreSQL database
+func SaveMessage(userID, sessionID string, message models.Message) error {
+	_, err := saveMessage(models.Db, userID, sessionID, message)
+	return err
+}
 
-func CreateGenAIClient() error {
-	var ctx = context.Background()
-	// Ensure the environment variable is set
-	credsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	if credsFile == "" {
-		log.Fatalf("GOOGLE_APPLICATION_CREDENTIALS environment variable not set")
+// saveMessage appends a message to the active branch of the session and
+// returns its ID
+func saveMessage(db execer, userID, sessionID string, message models.Message) (int64, error) {
+	stmt := `INSERT INTO chat_sessions(user_id, session_id, message, sender, parent_id)
+	VALUES ($1, $2, $3, $4, (
+		SELECT MAX(id) FROM chat_sessions WHERE user_id = $1 AND session_id = $2 AND active
+	)) RETURNING id`
+	var id int64
+	if err := db.QueryRow(stmt, userID, sessionID, message.Content, message.Sender).Scan(&id); err != nil {
+		return 0, err
 	}
-	var err error
-	GenaiClient, err = genai.NewClient(ctx, projectID, location, option.WithCredentialsFile(credsFile))
-	return err
+	return id, touchSession(db, userID, sessionID)
 }
 
-func GenerateContentFromFile(
-	c context.Context,
-	file *multipart.FileHeader,
-) (*genai.GenerateContentResponse, error) {
-	f, err := file.Open()
+// LoadMessages loads the messages of the active branch of a session from
+// PostgreSQL database
+func LoadMessages(userID, sessionID string) ([]models.Message, error) {
+	stored, err := loadStoredMessages(userID, sessionID)
 	if err != nil {
-		return nil, fmt.Errorf("could not open file")
+		return nil, err
 	}
-	defer f.Close()
-
-	gemini := GenaiClient.GenerativeModel(ModelName)
-	gemini.SetTemperature(1)
+	messages := make([]models.Message, 0, len(stored))
+	for _, message := range stored {
+		messages = append(messages, message.Message)
+	}
+	return messages, nil
+}
 
-	fileBytes, err := io.ReadAll(f)
+// LoadChatHistory loads the active branch of the chat from PostgreSQL
+// database and the session's files from the blob store, fitted into the
+// model's context window. It also returns the ID of the last file in the
+// history, for LoadNewAttachments.
+func LoadChatHistory(ctx context.Context, userID, sessionID string) ([]*genai.Content, int64, error) {
+	messages, err := loadStoredMessages(userID, sessionID)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read file")
+		return nil, 0, err
 	}
+	return loadChatHistory(ctx, userID, sessionID, messages)
+}
 
-	ext := strings.ToLower(filepath.Ext(file.Filename))
+// loadChatHistory is LoadChatHistory for the messages of any branch. All
+// files are kept, the ones sent after the branch end the history.
+func loadChatHistory(ctx context.Context, userID, sessionID string, messages []storedMessage) ([]*genai.Content, int64, error) {
+	attachments, err := listAttachments(userID, sessionID)
+	if err != nil {
+		return nil, 0, err
+	}
+	lastID := int64(0)
+	for _, a := range attachments {
+		if a.parts, err = attachmentParts(ctx, userID, a); err != nil {
+			return nil, 0, err
+		}
+		lastID = a.ID
+	}
+	history, err := buildChatHistory(ctx, userID, sessionID, attachments, messages)
+	return history, lastID, err
+}
 
-	prompt := "Generate a details story to describe this file"
-	switch ext {
-	case ".jpg", ".jpeg":
-		return gemini.GenerateContent(c, genai.Text(prompt), genai.ImageData("jpeg", fileBytes))
-	case ".png":
-		return gemini.GenerateContent(c, genai.Text(prompt), genai.ImageData("png", fileBytes))
-	case ".pdf":
-		return gemini.GenerateContent(c, genai.Text(prompt), genai.Blob{MIMEType: "application/pdf", Data: fileBytes})
-	default:
-		return nil, fmt.Errorf("unknown or unsupported file format")
+// loadFileData returns the content of a file of the user
+func loadFileData(ctx context.Context, userID string, fileID int64) ([]byte, error) {
+	fileData := []byte{}
+	storageKey := sql.NullString{}
+	stmt := "SELECT storage_key, file_data FROM session_files WHERE user_id=$1 AND id=$2"
+	if err := models.Db.QueryRow(stmt, userID, fileID).Scan(&storageKey, &fileData); err != nil {
+		return nil, err
+	}
+	if storageKey.Valid {
+		return readBlob(ctx, storageKey.String)
 	}
+	return fileData, nil
 }
 
-// SaveMessage save message to PostgreSQL database
-func SaveMessage(userID, sessionID string, message models.Message) error {
-	stmt := "INSERT INTO chat_sessions(user_id, session_id, message, sender) VALUES ($1, $2, $3, $4)"
-	_, err := models.Db.Exec(stmt, userID, sessionID, message.Content, message.Sender)
-	return err
+// loadFileText returns the text extracted from a written document
+func loadFileText(userID string, fileID int64) (string, error) {
+	text := ""
+	stmt := "SELECT text_content FROM session_files WHERE user_id=$1 AND id=$2"
+	err := models.Db.QueryRow(stmt, userID, fileID).Scan(&text)
+	return text, err
+}
+
+// storedMessage is a chat_sessions row
+type storedMessage struct {
+	id       int64
+	parentID int64
+	models.Message
 }
 
-// LoadMessage load messages from PostgreSQL database
-func LoadMessages(sessionID string) ([]models.Message, error) {
-	stmt := "SELECT message, sender FROM chat_sessions WHERE session_id = $1 ORDER BY timestamp"
-	rows, err := models.Db.Query(stmt, sessionID)
+const storedMessageColumns = "id, COALESCE(parent_id, 0), sender, message"
+
+// loadStoredMessages returns the messages of the active branch
+func loadStoredMessages(userID, sessionID string) ([]storedMessage, error) {
+	stmt := "SELECT " + storedMessageColumns + ` FROM chat_sessions
+	WHERE user_id=$1 AND session_id=$2 AND active ORDER BY id`
+	return queryStoredMessages(stmt, userID, sessionID)
+}
+
+// loadBranch returns the messages from the first one of the session to
+// leafID, in order
+func loadBranch(userID, sessionID string, leafID int64) ([]storedMessage, error) {
+	stmt := `WITH RECURSIVE branch AS (
+		SELECT * FROM chat_sessions WHERE user_id = $1 AND session_id = $2 AND id = $3
+		UNION ALL
+		SELECT c.* FROM chat_sessions c JOIN branch b ON c.id = b.parent_id
+		WHERE c.user_id = $1 AND c.session_id = $2
+	)
+	SELECT ` + storedMessageColumns + " FROM branch ORDER BY id"
+	return queryStoredMessages(stmt, userID, sessionID, leafID)
+}
+
+func queryStoredMessages(stmt string, args ...interface{}) ([]storedMessage, error) {
+	rows, err := models.Db.Query(stmt, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var messages []models.Message
+	messages := []storedMessage{}
 	for rows.Next() {
-		var message models.Message
-		if err := rows.Scan(&message.Content, &message.Sender); err != nil {
+		var message storedMessage
+		if err := rows.Scan(&message.id, &message.parentID, &message.Sender, &message.Content); err != nil {
 			return nil, err
 		}
+		message.ID = strconv.FormatInt(message.id, 10)
+		if message.parentID != 0 {
+			message.ParentID = strconv.FormatInt(message.parentID, 10)
+		}
 		messages = append(messages, message)
 	}
-	return messages, nil
+	return messages, rows.Err()
 }
 
-// LoadChatHistory loads chat history from PostgreSQL database
-func LoadChatHistory(userID, sessionID string) ([]*genai.Content, error) {
-	contentType := ""
-	fileData := []byte{}
-	stmt := "SELECT file_data, content_type FROM session_files WHERE user_id=$1 AND session_id=$2"
-	if err := models.Db.QueryRow(stmt, userID, sessionID).Scan(&fileData, &contentType); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			log.Printf("there is no file of user %s, and session %s", userID, sessionID)
-		default:
-			return nil, err
+// SaveFileData streams the uploaded file to the blob store, records it with its
+// detected content type and returns its ID
+func SaveFileData(
+	ctx context.Context,
+	userID, sessionID string,
+	file *multipart.FileHeader,
+	contentType string,
+) (int64, error) {
+	f, err := file.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return saveFile(ctx, userID, sessionID, file.Filename, f, file.Size, contentType)
+}
+
+// saveFile stores the file with the metadata extracted from it, and the text
+// of written documents
+func saveFile(
+	ctx context.Context,
+	userID, sessionID, filename string,
+	r io.ReadSeeker,
+	size int64,
+	contentType string,
+) (int64, error) {
+	filename = filepath.Base(filename)
+	metadata := []byte(nil)
+	if meta := ExtractMetadata(r, contentType); meta != nil {
+		var err error
+		if metadata, err = json.Marshal(meta); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	text := sql.NullString{}
+	if isTextDocument(contentType) {
+		if size > maxDocumentSize {
+			return 0, fmt.Errorf("%w: larger than %d bytes", ErrDocumentTooLarge, maxDocumentSize)
+		}
+		data, err := io.ReadAll(io.LimitReader(r, maxDocumentSize+1))
+		if err != nil {
+			return 0, err
+		}
+		if text.String, err = ExtractDocumentText(data, contentType); err != nil {
+			return 0, err
+		}
+		text.Valid = true
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return 0, err
 		}
 	}
 
-	stmt = "SELECT sender, message FROM chat_sessions WHERE user_id=$1 AND session_id=$2 ORDER BY timestamp"
-	rows, err := models.Db.Query(stmt, userID, sessionID)
+	key, err := newBlobKey(userID, strings.ToLower(filepath.Ext(filename)))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-
-	// add media data first
-	contents := []*genai.Content{
-		{
-			Role:  "user",
-			Parts: []genai.Part{genai.Blob{MIMEType: contentType, Data: fileData}},
-		},
+	hash := sha256.New()
+	if err := Blobs.Put(ctx, key, io.TeeReader(r, hash), size, contentType); err != nil {
+		return 0, err
 	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
 
-	for rows.Next() {
-		var message models.Message
-		if err := rows.Scan(&message.Sender, &message.Content); err != nil {
-			return nil, err
+	// The file joins the conversation after the last message sent so far
+	stmt := `INSERT INTO session_files(user_id, session_id, filename, content_type, storage_key, size, checksum, metadata, text_content, after_message_id)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, (
+		SELECT COALESCE(MAX(id), 0) FROM chat_sessions WHERE user_id = $1 AND session_id = $2
+	)) RETURNING id
+	`
+
+	var id int64
+	err = models.Db.QueryRow(stmt, userID, sessionID, filename, contentType, key, size, checksum, metadata, text).Scan(&id)
+	if err != nil {
+		if deleteErr := Blobs.Delete(ctx, key); deleteErr != nil {
+			log.Printf("could not delete blob %s: %v", key, deleteErr)
 		}
-		contents = append(contents, &genai.Content{
-			Role:  message.Sender,
-			Parts: []genai.Part{genai.Text(message.Content)},
-		})
+		return 0, err
 	}
-	return contents, nil
+	return id, nil
 }
 
-func SaveFileData(userID, sessionID string, file *multipart.FileHeader) error {
-	filename := filepath.Base(file.Filename)
-	contentType := file.Header.Get("content-type")
-	f, err := file.Open()
+// DiscardUpload deletes the files saved for an upload that did not go
+// through, together with their blobs. newSession tells the upload created
+// the session, which then goes too unless something else was added to it.
+func DiscardUpload(ctx context.Context, userID, sessionID string, fileIDs []int64, newSession bool) error {
+	tx, err := models.Db.Begin()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer tx.Rollback()
 
-	fileData, err := io.ReadAll(f)
-	if err != nil {
+	keys := []sql.NullString{}
+	for _, fileID := range fileIDs {
+		key, err := deleteFile(tx, userID, sessionID, fileID)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if newSession {
+		if err := deleteEmptySession(tx, userID, sessionID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
 		return err
 	}
+	for _, key := range keys {
+		deleteFileBlob(ctx, key)
+	}
+	return nil
+}
 
-	stmt := `INSERT INTO session_files(user_id, session_id, filename, content_type, file_data)
-	VALUES ($1, $2, $3, $4, $5) RETURNING id
-	`
+// deleteFile deletes a session_files row and returns its storage key. The
+// session falls back to its first remaining file.
+func deleteFile(tx *sql.Tx, userID, sessionID string, fileID int64) (sql.NullString, error) {
+	key := sql.NullString{}
+	stmt := "DELETE FROM session_files WHERE user_id = $1 AND session_id = $2 AND id = $3 RETURNING storage_key"
+	err := tx.QueryRow(stmt, userID, sessionID, fileID).Scan(&key)
+	if err != nil && err != sql.ErrNoRows {
+		return key, err
+	}
+
+	stmt = `UPDATE sessions SET file_id = (
+		SELECT MIN(id) FROM session_files WHERE user_id = $1 AND session_id = $2
+	) WHERE user_id = $1 AND id = $2 AND file_id IS NULL`
+	_, err = tx.Exec(stmt, userID, sessionID)
+	return key, err
+}
 
-	return models.Db.QueryRow(stmt, userID, sessionID, filename, contentType, fileData).Err()
+// deleteFileBlob removes the blob of a deleted file. The row is gone, a blob
+// left behind here is only wasted space.
+func deleteFileBlob(ctx context.Context, key sql.NullString) {
+	if !key.Valid {
+		return
+	}
+	if err := Blobs.Delete(ctx, key.String); err != nil {
+		log.Printf("could not delete blob %s: %v", key.String, err)
+	}
 }
 
-func GetStories(userID string) ([]string, error) {
-	stmt := "SELECT session_id FROM chat_sessions WHERE user_id = $1"
+const (
+	StorySortLastActivity = "last_activity"
+	StorySortCreatedAt    = "created_at"
 
-	rows, err := models.Db.Query(stmt, userID)
+	defaultStoryPageSize = 20
+	maxStoryPageSize     = 100
+	storyPreviewLength   = 200
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort option")
+)
+
+// StoryListOptions controls paging and ordering of ListStories
+type StoryListOptions struct {
+	Sort   string
+	Asc    bool
+	Limit  int
+	Cursor string
+}
+
+// storyCursor is the position after the last story of a page, in the order
+// the page was listed in. Stories with the same sort key are ordered by
+// session ID, so ID breaks the tie.
+type storyCursor struct {
+	Key  time.Time `json:"k"`
+	ID   string    `json:"id"`
+	Sort string    `json:"s"`
+	Asc  bool      `json:"a,omitempty"`
+}
+
+func encodeStoryCursor(c storyCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeStoryCursor returns ErrInvalidCursor for a malformed cursor and for
+// one of a page listed in another order
+func decodeStoryCursor(s, sort string, asc bool) (*storyCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := storyCursor{}
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	if c.Sort != sort || c.Asc != asc {
+		return nil, fmt.Errorf("%w: it continues a list in another order", ErrInvalidCursor)
+	}
+	return &c, nil
+}
+
+// ListStories returns one entry per session of the user with a preview of the
+// story, the source file and message statistics
+func ListStories(userID string, opts StoryListOptions) (*models.StoryPage, error) {
+	if opts.Sort == "" {
+		opts.Sort = StorySortLastActivity
+	}
+	if opts.Sort != StorySortLastActivity && opts.Sort != StorySortCreatedAt {
+		return nil, ErrInvalidSort
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultStoryPageSize
+	}
+	if opts.Limit > maxStoryPageSize {
+		opts.Limit = maxStoryPageSize
+	}
+
+	direction, comparison := "DESC", "<"
+	if opts.Asc {
+		direction, comparison = "ASC", ">"
+	}
+
+	args := []interface{}{userID}
+	where := ""
+	if opts.Cursor != "" {
+		cursor, err := decodeStoryCursor(opts.Cursor, opts.Sort, opts.Asc)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, cursor.Key, cursor.ID)
+		// session_id breaks ties of the sort key, so no story is repeated
+		// or skipped between pages
+		where = fmt.Sprintf("WHERE (%s, session_id) %s ($2, $3)", opts.Sort, comparison)
+	}
+	// Fetch one extra row to know whether there is a next page
+	args = append(args, opts.Limit+1)
+
+	stmt := fmt.Sprintf(`SELECT session_id, title, preview, filename, content_type, message_count, created_at, last_activity
+	FROM (
+		SELECT s.id AS session_id, s.title, s.created_at,
+			COALESCE(p.message, '') AS preview,
+			COALESCE(f.filename, '') AS filename,
+			COALESCE(f.content_type, '') AS content_type,
+			COALESCE(m.message_count, 0) AS message_count,
+			COALESCE(m.last_activity, s.updated_at) AS last_activity
+		FROM sessions s
+		LEFT JOIN session_files f ON f.id = s.file_id
+		LEFT JOIN LATERAL (
+			SELECT COUNT(*) AS message_count, MAX(timestamp) AS last_activity
+			FROM chat_sessions WHERE user_id = s.user_id AND session_id = s.id AND active
+		) m ON true
+		LEFT JOIN LATERAL (
+			SELECT message FROM chat_sessions
+			WHERE user_id = s.user_id AND session_id = s.id AND sender = 'model' AND active
+			ORDER BY timestamp, id LIMIT 1
+		) p ON true
+		WHERE s.user_id = $1
+	) stories
+	%s
+	ORDER BY %s %s, session_id %s
+	LIMIT $%d`, where, opts.Sort, direction, direction, len(args))
+
+	rows, err := models.Db.Query(stmt, args...)
 	if err != nil {
 		return nil, err
 	}
-	sessionIDs := []string{}
-	sessionID := ""
+	defer rows.Close()
+
+	page := &models.StoryPage{Stories: []*models.StorySummary{}}
 	for rows.Next() {
-		if err = rows.Scan(&sessionID); err != nil {
+		story := models.StorySummary{}
+		if err := rows.Scan(
+			&story.SessionID, &story.Title, &story.Preview, &story.Filename, &story.ContentType,
+			&story.MessageCount, &story.CreatedAt, &story.LastActivity,
+		); err != nil {
 			return nil, err
 		}
-		sessionIDs = append(sessionIDs, sessionID)
+		if preview := []rune(story.Preview); len(preview) > storyPreviewLength {
+			story.Preview = string(preview[:storyPreviewLength]) + "…"
+		}
+		page.Stories = append(page.Stories, &story)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Stories) > opts.Limit {
+		page.Stories = page.Stories[:opts.Limit]
+		last := page.Stories[len(page.Stories)-1]
+		key := last.LastActivity
+		if opts.Sort == StorySortCreatedAt {
+			key = last.CreatedAt
+		}
+		page.NextCursor = encodeStoryCursor(storyCursor{Key: key, ID: last.SessionID, Sort: opts.Sort, Asc: opts.Asc})
 	}
-	return sessionIDs, nil
+	return page, nil
 }
@@ -0,0 +1,49 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecodeStoryCursor(t *testing.T) {
+	key := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	cursor := encodeStoryCursor(storyCursor{Key: key, ID: "s1", Sort: StorySortLastActivity})
+	ascCursor := encodeStoryCursor(storyCursor{Key: key, ID: "s1", Sort: StorySortCreatedAt, Asc: true})
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name    string
+		cursor  string
+		sort    string
+		asc     bool
+		wantErr bool
+	}{
+		{name: "same order", cursor: cursor, sort: StorySortLastActivity},
+		{name: "same ascending order", cursor: ascCursor, sort: StorySortCreatedAt, asc: true},
+		{name: "other sort", cursor: cursor, sort: StorySortCreatedAt, wantErr: true},
+		{name: "other direction", cursor: cursor, sort: StorySortLastActivity, asc: true, wantErr: true},
+		{name: "not base64", cursor: "not a cursor!", sort: StorySortLastActivity, wantErr: true},
+		{name: "not json", cursor: encode("plain"), sort: StorySortLastActivity, wantErr: true},
+		{name: "without id", cursor: encode(`{"k":"2024-05-01T12:30:00Z","s":"last_activity"}`), sort: StorySortLastActivity, wantErr: true},
+		{name: "without sort", cursor: encode(`{"k":"2024-05-01T12:30:00Z","id":"s1"}`), sort: StorySortLastActivity, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeStoryCursor(tt.cursor, tt.sort, tt.asc)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidCursor) {
+					t.Fatalf("error = %v, want %v", err, ErrInvalidCursor)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Key.Equal(key) || got.ID != "s1" {
+				t.Errorf("cursor = %+v, want key %v and id s1", got, key)
+			}
+		})
+	}
+}
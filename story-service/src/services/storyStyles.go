@@ -0,0 +1,248 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode/utf8"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+const (
+	DefaultStoryStyle  = "story"
+	DefaultStoryLength = "medium"
+
+	maxStoryLanguageLength = 40
+	maxStoryAudienceLength = 100
+)
+
+var ErrInvalidStoryOptions = errors.New("invalid story options")
+
+// StoryStyle is a prompt template for one genre of story. Template is a
+// text/template executed with StoryPromptData.
+type StoryStyle struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Template    string  `json:"template"`
+	Temperature float32 `json:"temperature"`
+
+	tmpl *template.Template
+}
+
+// StoryOptions are the choices a user makes when uploading a file
+type StoryOptions struct {
+	Style    string `json:"style"`
+	Length   string `json:"length"`
+	Language string `json:"language"`
+	Audience string `json:"audience"`
+	// Album asks for one narrative across several photos
+	Album bool `json:"album,omitempty"`
+}
+
+// StoryPromptData is what a style template can refer to
+type StoryPromptData struct {
+	// Timed is true for video and audio, where events happen in order
+	Timed    bool
+	Words    int
+	Language string
+	Audience string
+}
+
+// StoryPrompt is a resolved prompt ready to be sent to the generator
+type StoryPrompt struct {
+	Text   string
+	Config genai.GenerationConfig
+}
+
+type storyLength struct {
+	words     int
+	maxTokens int32
+}
+
+var storyLengths = map[string]storyLength{
+	"short":  {words: 150, maxTokens: 1024},
+	"medium": {words: 400, maxTokens: 2048},
+	"long":   {words: 900, maxTokens: 4096},
+}
+
+const storyInstructions = `{{if .Language}} Write it in {{.Language}}.{{end}}` +
+	`{{if .Audience}} The audience is {{.Audience}}.{{end}}` +
+	` Keep it around {{.Words}} words.`
+
+var defaultStoryStyles = []StoryStyle{
+	{
+		Name:        DefaultStoryStyle,
+		Description: "A detailed story describing the file",
+		Template: `{{if .Timed}}Generate a details story from this recording. ` +
+			`Narrate the events in the order they happen, describing what is seen and heard as the recording goes on.` +
+			`{{else}}Generate a details story to describe this file.{{end}}` + storyInstructions,
+		Temperature: 1,
+	},
+	{
+		Name:        "childrens_tale",
+		Description: "A gentle tale for young children",
+		Template: `Turn this {{if .Timed}}recording{{else}}file{{end}} into a warm children's tale with simple words, ` +
+			`a friendly main character and a happy ending.` +
+			`{{if .Timed}} Follow the events in the order they happen.{{end}}` + storyInstructions,
+		Temperature: 0.9,
+	},
+	{
+		Name:        "news_report",
+		Description: "A neutral news article",
+		Template: `Write a news report about what this {{if .Timed}}recording{{else}}file{{end}} shows. ` +
+			`Start with a headline, answer who, what, when and where, and keep a neutral tone.` +
+			`{{if .Timed}} Report the events in chronological order.{{end}}` + storyInstructions,
+		Temperature: 0.4,
+	},
+	{
+		Name:        "poem",
+		Description: "A poem inspired by the file",
+		Template: `Write a poem inspired by this {{if .Timed}}recording, following its events as they unfold{{else}}file{{end}}. ` +
+			`Use vivid imagery and a consistent rhythm.` + storyInstructions,
+		Temperature: 1,
+	},
+	{
+		Name:        "noir",
+		Description: "A hard-boiled detective story",
+		Template: `Write a noir detective story set in what this {{if .Timed}}recording{{else}}file{{end}} shows, ` +
+			`told in the first person by a world-weary narrator with terse, atmospheric sentences.` +
+			`{{if .Timed}} Let the plot follow the events in the order they happen.{{end}}` + storyInstructions,
+		Temperature: 1,
+	},
+	{
+		Name:        "factual",
+		Description: "A factual description without invented details",
+		Template: `Describe {{if .Timed}}what happens in this recording, in order,{{else}}this file{{end}} factually. ` +
+			`Only state what can be seen{{if .Timed}} or heard{{end}} and do not invent details.` + storyInstructions,
+		Temperature: 0.2,
+	},
+}
+
+var (
+	storyStylesMu sync.RWMutex
+	storyStyles   = map[string]*StoryStyle{}
+)
+
+// LoadStoryStyles registers the built-in styles and then the styles from the
+// JSON file named by STORY_STYLES_FILE, which may add styles or replace
+// built-in ones
+func LoadStoryStyles() error {
+	styles := append([]StoryStyle{}, defaultStoryStyles...)
+
+	if path := os.Getenv("STORY_STYLES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		custom := []StoryStyle{}
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return fmt.Errorf("could not parse %s: %w", path, err)
+		}
+		styles = append(styles, custom...)
+	}
+
+	registry := map[string]*StoryStyle{}
+	for i := range styles {
+		style := styles[i]
+		if style.Name == "" {
+			return fmt.Errorf("story style without a name")
+		}
+		tmpl, err := template.New(style.Name).Option("missingkey=error").Parse(style.Template)
+		if err != nil {
+			return fmt.Errorf("story style %s: %w", style.Name, err)
+		}
+		style.tmpl = tmpl
+		registry[style.Name] = &style
+	}
+
+	storyStylesMu.Lock()
+	storyStyles = registry
+	storyStylesMu.Unlock()
+	log.Printf("loaded %d story styles", len(registry))
+	return nil
+}
+
+// ListStoryStyles returns the registered styles ordered by name
+func ListStoryStyles() []StoryStyle {
+	storyStylesMu.RLock()
+	defer storyStylesMu.RUnlock()
+
+	styles := make([]StoryStyle, 0, len(storyStyles))
+	for _, style := range storyStyles {
+		styles = append(styles, *style)
+	}
+	sort.Slice(styles, func(i, j int) bool { return styles[i].Name < styles[j].Name })
+	return styles
+}
+
+// StoryLengths returns the accepted target lengths from shortest to longest
+func StoryLengths() []string {
+	lengths := make([]string, 0, len(storyLengths))
+	for name := range storyLengths {
+		lengths = append(lengths, name)
+	}
+	sort.Slice(lengths, func(i, j int) bool { return storyLengths[lengths[i]].words < storyLengths[lengths[j]].words })
+	return lengths
+}
+
+// albumInstruction turns a style's prompt into one for a photo album
+const albumInstruction = "The photos below belong to one album and are in the order they were taken. " +
+	"Write a single continuous narrative that moves through them in that order, " +
+	"not a separate story for each photo."
+
+// BuildStoryPrompt resolves the options through the style registry into the
+// prompt for a file of the given MIME type
+func BuildStoryPrompt(opts StoryOptions, mimeType string) (*StoryPrompt, error) {
+	if opts.Style == "" {
+		opts.Style = DefaultStoryStyle
+	}
+	if opts.Length == "" {
+		opts.Length = DefaultStoryLength
+	}
+
+	storyStylesMu.RLock()
+	style, ok := storyStyles[opts.Style]
+	storyStylesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown style %q", ErrInvalidStoryOptions, opts.Style)
+	}
+	length, ok := storyLengths[opts.Length]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown length %q", ErrInvalidStoryOptions, opts.Length)
+	}
+	language := strings.TrimSpace(opts.Language)
+	if utf8.RuneCountInString(language) > maxStoryLanguageLength {
+		return nil, fmt.Errorf("%w: language is too long", ErrInvalidStoryOptions)
+	}
+	audience := strings.TrimSpace(opts.Audience)
+	if utf8.RuneCountInString(audience) > maxStoryAudienceLength {
+		return nil, fmt.Errorf("%w: audience is too long", ErrInvalidStoryOptions)
+	}
+
+	var text strings.Builder
+	err := style.tmpl.Execute(&text, StoryPromptData{
+		Timed:    isTimedMedia(mimeType),
+		Words:    length.words,
+		Language: language,
+		Audience: audience,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Album {
+		text.WriteString("\n\n" + albumInstruction)
+	}
+
+	prompt := &StoryPrompt{Text: text.String()}
+	prompt.Config.SetTemperature(style.Temperature)
+	prompt.Config.SetMaxOutputTokens(length.maxTokens)
+	return prompt, nil
+}
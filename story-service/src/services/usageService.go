@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/nhat8002nguyen/story-of-media-be/story-service/src/models"
+)
+
+const (
+	UsageStory   = "story"
+	UsageChat    = "chat"
+	UsageSummary = "summary"
+	UsageChunk   = "chunk"
+
+	UsageDaily   = "day"
+	UsageMonthly = "month"
+)
+
+// modelPrice is the price in USD per million tokens
+type modelPrice struct {
+	input  float64
+	output float64
+}
+
+var modelPrices = map[string]modelPrice{
+	ModelName:          {input: 0.075, output: 0.30},
+	defaultOpenAIModel: {input: 0.15, output: 0.60},
+	fakeModelName:      {input: 0, output: 0},
+}
+
+// priceOf returns the price of the model. MODEL_INPUT_PRICE and
+// MODEL_OUTPUT_PRICE override it for every model.
+func priceOf(model string) modelPrice {
+	price := modelPrices[model]
+	if value, err := strconv.ParseFloat(os.Getenv("MODEL_INPUT_PRICE"), 64); err == nil {
+		price.input = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("MODEL_OUTPUT_PRICE"), 64); err == nil {
+		price.output = value
+	}
+	return price
+}
+
+// EstimateCost returns the estimated cost in USD of a generation
+func EstimateCost(model string, promptTokens, candidateTokens int32) float64 {
+	price := priceOf(model)
+	return (float64(promptTokens)*price.input + float64(candidateTokens)*price.output) / 1e6
+}
+
+// RecordUsage saves the usage metadata of a generation. Responses without
+// usage metadata are ignored. Failures are only logged, the generation
+// itself went through.
+func RecordUsage(userID, sessionID, operation string, usage *genai.UsageMetadata) {
+	if usage == nil {
+		return
+	}
+	addTokenUsage(context.Background(), userID, int64(usage.TotalTokenCount))
+
+	model := Generator.Name()
+	stmt := `INSERT INTO model_usage(user_id, session_id, model, operation, prompt_tokens, candidate_tokens, total_tokens, cost)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := models.Db.Exec(stmt, userID, sessionID, model, operation,
+		usage.PromptTokenCount, usage.CandidatesTokenCount, usage.TotalTokenCount,
+		EstimateCost(model, usage.PromptTokenCount, usage.CandidatesTokenCount))
+	if err != nil {
+		log.Printf("could not record %s usage of session %s: %v", operation, sessionID, err)
+	}
+}
+
+// GetUsage returns the usage of the user between from and to, rolled up by
+// day or month
+func GetUsage(userID, period string, from, to time.Time) ([]*models.UsageRollup, error) {
+	stmt := `SELECT date_trunc($2, created_at) AS period_start, COUNT(*),
+		COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(candidate_tokens), 0),
+		COALESCE(SUM(total_tokens), 0), COALESCE(SUM(cost), 0)
+	FROM model_usage
+	WHERE user_id = $1 AND created_at >= $3 AND created_at < $4
+	GROUP BY period_start
+	ORDER BY period_start`
+	rows, err := models.Db.Query(stmt, userID, period, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rollups := []*models.UsageRollup{}
+	for rows.Next() {
+		rollup := models.UsageRollup{}
+		if err := rows.Scan(
+			&rollup.PeriodStart, &rollup.Requests, &rollup.PromptTokens,
+			&rollup.CandidateTokens, &rollup.TotalTokens, &rollup.Cost,
+		); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, &rollup)
+	}
+	return rollups, rows.Err()
+}
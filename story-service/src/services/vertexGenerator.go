@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/option"
+)
+
+const (
+	projectID = "analyzing-media-files-web-app"
+	location  = "asia-southeast1"
+	ModelName = "gemini-1.5-flash-001"
+
+	vertexContextWindow = 1048576
+)
+
+type vertexGenerator struct {
+	client *genai.Client
+}
+
+func newVertexGenerator(ctx context.Context) (*vertexGenerator, error) {
+	// Ensure the environment variable is set
+	credsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if credsFile == "" {
+		return nil, fmt.Errorf("GOOGLE_APPLICATION_CREDENTIALS environment variable not set")
+	}
+	client, err := genai.NewClient(ctx, projectID, location, option.WithCredentialsFile(credsFile))
+	if err != nil {
+		return nil, err
+	}
+	return &vertexGenerator{client: client}, nil
+}
+
+func (g *vertexGenerator) Name() string {
+	return ModelName
+}
+
+func (g *vertexGenerator) GenerateContent(
+	ctx context.Context,
+	config genai.GenerationConfig,
+	parts ...genai.Part,
+) (*genai.GenerateContentResponse, error) {
+	gemini := g.client.GenerativeModel(ModelName)
+	gemini.GenerationConfig = config
+	resp, err := gemini.GenerateContent(ctx, parts...)
+	return resp, ClassifyGenerationError(err)
+}
+
+func (g *vertexGenerator) ContextWindow() int {
+	return vertexContextWindow
+}
+
+// SupportsMediaType is true for every supported upload type
+func (g *vertexGenerator) SupportsMediaType(mimeType string) bool {
+	return true
+}
+
+func (g *vertexGenerator) CountTokens(ctx context.Context, contents []*genai.Content) (int, error) {
+	parts := []genai.Part{}
+	for _, content := range contents {
+		parts = append(parts, content.Parts...)
+	}
+	resp, err := g.client.GenerativeModel(ModelName).CountTokens(ctx, parts...)
+	if err != nil {
+		return 0, err
+	}
+	return int(resp.TotalTokens), nil
+}
+
+func (g *vertexGenerator) StartChat(history []*genai.Content) ChatSession {
+	chat := g.client.GenerativeModel(ModelName).StartChat()
+	chat.History = history
+	return &vertexChat{chat: chat}
+}
+
+type vertexChat struct {
+	chat *genai.ChatSession
+}
+
+func (cs *vertexChat) SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	resp, err := cs.chat.SendMessage(ctx, parts...)
+	return resp, ClassifyGenerationError(err)
+}
+
+func (cs *vertexChat) SendMessageStream(ctx context.Context, parts ...genai.Part) ResponseIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	return &vertexIterator{iter: cs.chat.SendMessageStream(ctx, parts...), cancel: cancel}
+}
+
+// vertexIterator reports blocked chunks as a GenerationError
+type vertexIterator struct {
+	iter   *genai.GenerateContentResponseIterator
+	cancel context.CancelFunc
+}
+
+func (it *vertexIterator) Next() (*genai.GenerateContentResponse, error) {
+	resp, err := it.iter.Next()
+	if err != nil {
+		return nil, ClassifyGenerationError(err)
+	}
+	return resp, nil
+}
+
+// Close cancels the stream, the context of SendMessageStream may outlive it
+func (it *vertexIterator) Close() error {
+	it.cancel()
+	return nil
+}
+
+func (cs *vertexChat) History() []*genai.Content {
+	return cs.chat.History
+}
+
+func (cs *vertexChat) SetHistory(history []*genai.Content) {
+	cs.chat.History = history
+}
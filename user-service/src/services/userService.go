@@ -13,7 +13,8 @@ import (
 var SecretKey []byte
 
 type Claims struct {
-	Email string
+	UserID string
+	Email  string
 	jwt.Claims
 }
 
@@ -79,7 +80,8 @@ func Authenticate(creds models.User) (string, error) {
 	}
 
 	claims := Claims{
-		Email: creds.Email,
+		UserID: u.ID,
+		Email:  creds.Email,
 		Claims: jwt.RegisteredClaims{
 			ExpiresAt: &jwt.NumericDate{
 				Time: time.Now().Add(30 * time.Minute),